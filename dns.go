@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+
+	"github.com/williambailey/pacproxy/pacfunc"
+)
+
+// newResolver configures how the PAC DNS functions, and WPAD, resolve hosts
+// using the -dns-* flags
+func newResolver() (pacfunc.Resolver, error) {
+	var resolver pacfunc.Resolver = net.DefaultResolver
+	if len(fDNSServer) > 0 {
+		resolver = pacfunc.NewServerResolver(fDNSServer...)
+	}
+	if fDNSTimeout > 0 {
+		resolver = pacfunc.TimeoutResolver{
+			Resolver: resolver,
+			Timeout:  fDNSTimeout,
+		}
+	}
+	if len(fDNSHost) > 0 {
+		resolver = pacfunc.HostsResolver{
+			Hosts:    fDNSHost,
+			Resolver: resolver,
+		}
+	}
+	if fDNSCache > 0 {
+		return pacfunc.NewDNSCache(
+			resolver,
+			pacfunc.DNSCacheSize(fDNSCache),
+			pacfunc.DNSCacheTTL(fDNSCacheTTL),
+			pacfunc.DNSCacheNegativeTTL(fDNSCacheNegTTL),
+		)
+	}
+	return resolver, nil
+}
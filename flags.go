@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// probeProxyFlag collects per proxy probe settings given as
+// "host:port=interval[,canary]". An interval of 0 disables probing.
+type probeProxyFlag map[string]probeProxySetting
+
+type probeProxySetting struct {
+	interval time.Duration
+	canary   string
+}
+
+func (f probeProxyFlag) String() string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(f))
+	for _, k := range keys {
+		v := fmt.Sprintf("%s=%s", k, f[k].interval)
+		if f[k].canary != "" {
+			v += "," + f[k].canary
+		}
+		parts = append(parts, v)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (f probeProxyFlag) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i < 0 {
+		return fmt.Errorf("expecting host:port=interval[,canary], got %q", value)
+	}
+	address := value[:i]
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return err
+	}
+	parts := strings.SplitN(value[i+1:], ",", 2)
+	interval, err := time.ParseDuration(parts[0])
+	if err != nil {
+		return err
+	}
+	setting := probeProxySetting{interval: interval}
+	if len(parts) == 2 {
+		if _, _, err := net.SplitHostPort(parts[1]); err != nil {
+			return err
+		}
+		setting.canary = parts[1]
+	}
+	f[address] = setting
+	return nil
+}
+
+// weightFlag collects proxy weights given as "host:port=weight"
+type weightFlag map[string]int
+
+func (f weightFlag) String() string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(f))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%d", k, f[k]))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (f weightFlag) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i < 0 {
+		return fmt.Errorf("expecting host:port=weight, got %q", value)
+	}
+	address := value[:i]
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return err
+	}
+	weight, err := strconv.Atoi(value[i+1:])
+	if err != nil {
+		return err
+	}
+	if weight < 0 {
+		return fmt.Errorf("weight for %q can't be negative", address)
+	}
+	f[address] = weight
+	return nil
+}
+
+// headerFlag collects HTTP headers given as "Name: value"
+type headerFlag [][2]string
+
+func (f *headerFlag) String() string {
+	parts := make([]string, 0, len(*f))
+	for _, h := range *f {
+		parts = append(parts, h[0]+": "+h[1])
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (f *headerFlag) Set(value string) error {
+	i := strings.Index(value, ":")
+	if i < 1 {
+		return fmt.Errorf("expecting Name: value, got %q", value)
+	}
+	*f = append(*f, [2]string{strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:])})
+	return nil
+}
+
+// stringsFlag collects every value given for a repeated flag, in order
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// hostsFlag collects static host addresses given as "host=ip[,ip...]"
+type hostsFlag map[string][]string
+
+func (f hostsFlag) String() string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(f))
+	for _, k := range keys {
+		parts = append(parts, k+"="+strings.Join(f[k], ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (f hostsFlag) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i < 1 {
+		return fmt.Errorf("expecting host=ip[,ip...], got %q", value)
+	}
+	host := strings.TrimSuffix(strings.ToLower(value[:i]), ".")
+	for _, ip := range strings.Split(value[i+1:], ",") {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("%q is not an IP address", ip)
+		}
+		f[host] = append(f[host], ip)
+	}
+	return nil
+}
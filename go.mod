@@ -1,8 +1,17 @@
 module github.com/williambailey/pacproxy
 
-go 1.13
+go 1.20
 
 require (
+	github.com/dop251/goja v0.0.0-20260106131823-651366fbe6e3
 	github.com/robertkrimen/otto v0.0.0-20180617131154-15f95af6e78d
+	golang.org/x/net v0.19.0
+)
+
+require (
+	github.com/dlclark/regexp2 v1.11.4 // indirect
+	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
+	github.com/google/pprof v0.0.0-20230207041349-798e818bf904 // indirect
+	golang.org/x/text v0.14.0 // indirect
 	gopkg.in/sourcemap.v1 v1.0.5 // indirect
 )
@@ -0,0 +1,94 @@
+// Package lru keeps a bounded number of expiring values, dropping the least
+// recently used when it is full. It is shared by the PAC result cache and the
+// DNS cache, which do their own locking.
+package lru
+
+import (
+	"container/list"
+	"fmt"
+	"time"
+)
+
+// New Cache that keeps at most size values
+func New(size int) (*Cache, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("cache size must be at least 1, got %d", size)
+	}
+	return &Cache{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}, nil
+}
+
+// Cache of values by key. It is not safe for concurrent use.
+type Cache struct {
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+	hits    uint64
+	misses  uint64
+}
+
+// Stats for a Cache
+type Stats struct {
+	Hits   uint64
+	Misses uint64
+	Size   int
+}
+
+type entry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// Get the value for key if it has not expired by now, counting a hit or miss
+func (c *Cache) Get(key string, now time.Time) (interface{}, bool) {
+	if e, ok := c.entries[key]; ok {
+		if now.Before(e.Value.(*entry).expires) {
+			c.hits++
+			c.lru.MoveToFront(e)
+			return e.Value.(*entry).value, true
+		}
+		c.remove(e)
+	}
+	c.misses++
+	return nil, false
+}
+
+// Add value for key until expires, dropping the least recently used values
+// to make room
+func (c *Cache) Add(key string, value interface{}, expires time.Time) {
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&entry{
+		key:     key,
+		value:   value,
+		expires: expires,
+	})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *Cache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*entry).key)
+}
+
+// Purge every value, keeping the counters
+func (c *Cache) Purge() {
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// Stats returns the hit and miss counters along with the current size
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Hits:   c.hits,
+		Misses: c.misses,
+		Size:   c.lru.Len(),
+	}
+}
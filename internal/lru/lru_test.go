@@ -0,0 +1,41 @@
+package lru
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	c, err := New(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Add("a", 1, now.Add(time.Minute))
+	c.Add("b", 2, now.Add(time.Second))
+	if v, ok := c.Get("a", now); !ok || v != 1 {
+		t.Errorf("expecting a to be 1, got %v, %v", v, ok)
+	}
+	c.Add("c", 3, now.Add(time.Minute))
+	if _, ok := c.Get("b", now); ok {
+		t.Error("expecting b, the least recently used, to have been dropped")
+	}
+	if _, ok := c.Get("c", now.Add(2*time.Minute)); ok {
+		t.Error("expecting c to have expired")
+	}
+	if s := c.Stats(); s != (Stats{Hits: 1, Misses: 2, Size: 1}) {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	c.Purge()
+	if s := c.Stats(); s != (Stats{Hits: 1, Misses: 2, Size: 0}) {
+		t.Errorf("expecting a purge to keep the counters, got %+v", s)
+	}
+}
+
+func TestNewSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		if _, err := New(size); err == nil {
+			t.Errorf("expecting an error for a size of %d", size)
+		}
+	}
+}
@@ -5,9 +5,14 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
+
+	"github.com/williambailey/pacproxy/pac"
+	"github.com/williambailey/pacproxy/pacfunc"
 )
 
-func newNonProxyHTTPHandler() http.Handler {
+func newNonProxyHTTPHandler(pacStatus func() string, resultCache *pac.CachingFinder, dnsCache *pacfunc.DNSCache, badProxies func() []pac.BadProxy) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/favicon.ico" {
 			w.Write(faviconIco)
@@ -15,8 +20,57 @@ func newNonProxyHTTPHandler() http.Handler {
 		}
 		http.Error(
 			w,
-			fmt.Sprintf("%s %s\nhttps://github.com/williambailey/pacproxy", Name, Version),
+			fmt.Sprintf(
+				"%s %s\nhttps://github.com/williambailey/pacproxy\nPAC: %s\n%s\n%s\n%s",
+				Name,
+				Version,
+				pacStatus(),
+				resultCacheStatus(resultCache),
+				dnsCacheStatus(dnsCache),
+				badProxyStatus(badProxies(), time.Now()),
+			),
 			http.StatusBadGateway,
 		)
 	})
 }
+
+// resultCacheStatus describes how well the cache of PAC results is doing,
+// nil being when -cache is disabled
+func resultCacheStatus(cache *pac.CachingFinder) string {
+	if cache == nil {
+		return "PAC result cache: disabled"
+	}
+	stats := cache.Stats()
+	return fmt.Sprintf("PAC result cache: %d entries, %d hits, %d misses", stats.Size, stats.Hits, stats.Misses)
+}
+
+// dnsCacheStatus describes how well the cache of the PAC DNS functions
+// lookups is doing, nil being when -dns-cache is disabled
+func dnsCacheStatus(cache *pacfunc.DNSCache) string {
+	if cache == nil {
+		return "DNS cache: disabled"
+	}
+	stats := cache.Stats()
+	return fmt.Sprintf("DNS cache: %d entries, %d hits, %d misses", stats.Size, stats.Hits, stats.Misses)
+}
+
+// badProxyStatus lists the proxies that are marked as bad along with when
+// they will next be tried
+func badProxyStatus(list []pac.BadProxy, now time.Time) string {
+	if len(list) == 0 {
+		return "Bad proxies: none"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Bad proxies: %d", len(list))
+	for _, bad := range list {
+		retry := "retrying now"
+		if now.Before(bad.RetryAt) {
+			retry = fmt.Sprintf("retry at %s, in %s", bad.RetryAt.UTC().Format(time.RFC3339), bad.RetryAt.Sub(now).Round(time.Second))
+		}
+		fmt.Fprintf(&b, "\n  %s: %d failures since %s, %s", bad.Proxy, bad.Failures, bad.Since.UTC().Format(time.RFC3339), retry)
+		if bad.LastError != nil {
+			fmt.Fprintf(&b, ", last error: %s", bad.LastError)
+		}
+	}
+	return b.String()
+}
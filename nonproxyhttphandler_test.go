@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/williambailey/pacproxy/pac"
+	"github.com/williambailey/pacproxy/pacfunc"
+)
+
+func TestNonProxyHTTPHandlerShowsBadProxies(t *testing.T) {
+	now := time.Now()
+	bad := []pac.BadProxy{
+		{
+			Proxy:     pac.Proxy{Type: pac.ProxyTypeHTTP, Hostname: "a.example.com", Port: 8080},
+			Failures:  3,
+			Since:     now.Add(-time.Hour),
+			RetryAt:   now.Add(10 * time.Minute),
+			LastError: errors.New("connection refused"),
+		},
+	}
+	h := newNonProxyHTTPHandler(
+		func() string { return "ok" },
+		nil,
+		nil,
+		func() []pac.BadProxy { return bad },
+	)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected status %d, got %d", http.StatusBadGateway, w.Code)
+	}
+	body, _ := ioutil.ReadAll(w.Body)
+	for _, expected := range []string{
+		"PAC: ok\n",
+		"PAC result cache: disabled\n",
+		"DNS cache: disabled\n",
+		"Bad proxies: 1\n",
+		"PROXY a.example.com:8080: 3 failures since " + bad[0].Since.UTC().Format(time.RFC3339),
+		"retry at " + bad[0].RetryAt.UTC().Format(time.RFC3339),
+		"last error: connection refused",
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("expected %q in the status page, got %q", expected, body)
+		}
+	}
+}
+
+func TestBadProxyStatus(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	if s := badProxyStatus(nil, now); s != "Bad proxies: none" {
+		t.Errorf("expected no bad proxies, got %q", s)
+	}
+	s := badProxyStatus([]pac.BadProxy{
+		{
+			Proxy:    pac.Proxy{Type: pac.ProxyTypeHTTP, Hostname: "a.example.com", Port: 8080},
+			Failures: 1,
+			Since:    now.Add(-5 * time.Minute),
+			RetryAt:  now.Add(90 * time.Second),
+		},
+		{
+			Proxy:    pac.Proxy{Type: pac.ProxyTypeSOCKS5, Hostname: "b.example.com", Port: 1080},
+			Failures: 2,
+			Since:    now.Add(-20 * time.Minute),
+			RetryAt:  now.Add(-time.Minute),
+		},
+	}, now)
+	expected := "Bad proxies: 2\n" +
+		"  PROXY a.example.com:8080: 1 failures since 2017-12-31T23:55:00Z, retry at 2018-01-01T00:01:30Z, in 1m30s\n" +
+		"  SOCKS5 b.example.com:1080: 2 failures since 2017-12-31T23:40:00Z, retrying now"
+	if s != expected {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+}
+
+func TestDNSCacheStatus(t *testing.T) {
+	cache, err := pacfunc.NewDNSCache(pacfunc.HostsResolver{
+		Hosts: map[string][]string{"a.example.com": {"192.0.2.1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.LookupHost(context.Background(), "a.example.com")
+	cache.LookupHost(context.Background(), "a.example.com")
+	cache.LookupHost(context.Background(), "b.example.com")
+	expected := "DNS cache: 2 entries, 1 hits, 2 misses"
+	if s := dnsCacheStatus(cache); s != expected {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+}
+
+func TestResultCacheStatus(t *testing.T) {
+	cache, err := pac.NewCachingFinder(pac.NewOttoEngine(pac.OttoStringLoader(pac.DirectPAC)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Stop()
+	for _, u := range []string{"http://a.example.com/", "http://a.example.com/page", "http://b.example.com/"} {
+		in, _ := url.Parse(u)
+		cache.FindProxyForURL(in)
+	}
+	expected := "PAC result cache: 2 entries, 1 hits, 2 misses"
+	if s := resultCacheStatus(cache); s != expected {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+}
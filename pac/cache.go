@@ -0,0 +1,173 @@
+package pac
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/williambailey/pacproxy/internal/lru"
+	"github.com/williambailey/pacproxy/pacfunc"
+)
+
+// CacheKey returns the key that a FindProxyForURL result is cached under
+type CacheKey func(in *url.URL) string
+
+// CacheKeyHost caches results per scheme and host, for PACs that only look at
+// the host
+func CacheKeyHost(in *url.URL) string {
+	return in.Scheme + "://" + in.Host
+}
+
+// CacheKeyURL caches results per URL, for PACs that also look at the path or
+// query
+func CacheKeyURL(in *url.URL) string {
+	return in.String()
+}
+
+// CachingFinderOpt used to configure a CachingFinder via the NewCachingFinder func
+type CachingFinderOpt func(*CachingFinder)
+
+// CacheSize sets the maximum number of results to keep
+func CacheSize(n int) CachingFinderOpt {
+	return func(c *CachingFinder) {
+		c.size = n
+	}
+}
+
+// CacheTTL sets how long a result is kept for
+func CacheTTL(d time.Duration) CachingFinderOpt {
+	return func(c *CachingFinder) {
+		c.ttl = d
+	}
+}
+
+// CacheKeyFunc sets how results are keyed, CacheKeyHost by default
+func CacheKeyFunc(fn CacheKey) CachingFinderOpt {
+	return func(c *CachingFinder) {
+		c.key = fn
+	}
+}
+
+// NewCachingFinder instance with configuration, which fails when the size is
+// less than 1
+func NewCachingFinder(finder ProxyFinder, opts ...CachingFinderOpt) (*CachingFinder, error) {
+	c := &CachingFinder{
+		finder: finder,
+		size:   1000,
+		ttl:    time.Minute,
+		key:    CacheKeyHost,
+		now:    time.Now,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	var err error
+	if c.lru, err = lru.New(c.size); err != nil {
+		return nil, fmt.Errorf("PAC result %s", err)
+	}
+	return c, nil
+}
+
+// CachingFinder keeps the most recently used results from another
+// ProxyFinder, so that the PAC is not evaluated for every request.
+// When the finder is also an EngineManager the cache is purged whenever it
+// is successfully reloaded.
+type CachingFinder struct {
+	mutex  sync.Mutex
+	finder ProxyFinder
+	size   int
+	ttl    time.Duration
+	key    CacheKey
+	now    func() time.Time
+	lru    *lru.Cache
+	purges int
+}
+
+// CacheStats for a CachingFinder
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Size   int
+}
+
+func (c *CachingFinder) FindProxyForURL(in *url.URL) (Proxies, error) {
+	key := c.key(in)
+	now := c.now()
+	c.mutex.Lock()
+	if value, ok := c.lru.Get(key, now); ok {
+		c.mutex.Unlock()
+		return append(Proxies{}, value.(Proxies)...), nil
+	}
+	purges := c.purges
+	c.mutex.Unlock()
+
+	proxies, err := c.finder.FindProxyForURL(in)
+	if err != nil {
+		return proxies, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if purges != c.purges {
+		// found using a PAC that has since been reloaded
+		return proxies, nil
+	}
+	c.lru.Add(key, append(Proxies{}, proxies...), now.Add(c.ttl))
+	return proxies, nil
+}
+
+// Purge every cached result
+func (c *CachingFinder) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lru.Purge()
+	c.purges++
+}
+
+// Stats returns the hit and miss counters along with the current size
+func (c *CachingFinder) Stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return CacheStats(c.lru.Stats())
+}
+
+func (c *CachingFinder) Start() error {
+	return c.manage(EngineManager.Start)
+}
+
+func (c *CachingFinder) Stop() error {
+	return c.manage(EngineManager.Stop)
+}
+
+func (c *CachingFinder) Reload() error {
+	return c.manage(EngineManager.Reload)
+}
+
+func (c *CachingFinder) manage(fn func(EngineManager) error) error {
+	m, ok := c.finder.(EngineManager)
+	if !ok {
+		return errors.New("cached ProxyFinder is not an EngineManager")
+	}
+	if err := fn(m); err != nil {
+		return err
+	}
+	stats := c.Stats()
+	c.Purge()
+	log.Printf("purged PAC result cache of %d entries, %d hits and %d misses so far", stats.Size, stats.Hits, stats.Misses)
+	return nil
+}
+
+// purgeDNSCache purges the lookups made by the PAC DNS functions using dns,
+// when they are cached, so that a reloaded PAC resolves hosts afresh
+func purgeDNSCache(dns pacfunc.DNS) {
+	cache, ok := dns.Resolver.(*pacfunc.DNSCache)
+	if !ok {
+		return
+	}
+	stats := cache.Stats()
+	cache.Purge()
+	log.Printf("purged DNS cache of %d entries, %d hits and %d misses so far", stats.Size, stats.Hits, stats.Misses)
+}
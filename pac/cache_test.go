@@ -0,0 +1,203 @@
+package pac
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/williambailey/pacproxy/pacfunc"
+)
+
+type countingFinder struct {
+	calls   int
+	reloads int
+	err     error
+}
+
+func (f *countingFinder) FindProxyForURL(in *url.URL) (Proxies, error) {
+	f.calls++
+	if f.err != nil {
+		return Proxies{}, f.err
+	}
+	return Proxies{Proxy{ProxyTypeHTTP, in.Hostname(), 8080 + f.reloads}}, nil
+}
+
+func (f *countingFinder) Start() error  { return nil }
+func (f *countingFinder) Stop() error   { return nil }
+func (f *countingFinder) Reload() error { f.reloads++; return nil }
+
+func mustParseURL(t *testing.T, u string) *url.URL {
+	in, err := url.Parse(u)
+	if err != nil {
+		t.Fatalf("failed to parse url: %q", err)
+	}
+	return in
+}
+
+func mustCachingFinder(t *testing.T, finder ProxyFinder, opts ...CachingFinderOpt) *CachingFinder {
+	c, err := NewCachingFinder(finder, opts...)
+	if err != nil {
+		t.Fatalf("failed to create the cache: %q", err)
+	}
+	return c
+}
+
+func mustDNSCache(t *testing.T, resolver pacfunc.Resolver, opts ...pacfunc.DNSCacheOpt) *pacfunc.DNSCache {
+	c, err := pacfunc.NewDNSCache(resolver, opts...)
+	if err != nil {
+		t.Fatalf("failed to create the DNS cache: %q", err)
+	}
+	return c
+}
+
+func TestCachingFinderByHost(t *testing.T) {
+	f := &countingFinder{}
+	c := mustCachingFinder(t, f)
+	a := Proxies{Proxy{ProxyTypeHTTP, "a.example.com", 8080}}
+	assertFind(t, c, "http://a.example.com/one.html", a, "")
+	assertFind(t, c, "http://a.example.com/two.html", a, "")
+	assertFind(t, c, "https://a.example.com/one.html", a, "")
+	if f.calls != 2 {
+		t.Errorf("expecting 2 lookups, got %d", f.calls)
+	}
+	if s := c.Stats(); s.Hits != 1 || s.Misses != 2 || s.Size != 2 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestCachingFinderByURL(t *testing.T) {
+	f := &countingFinder{}
+	c := mustCachingFinder(t, f, CacheKeyFunc(CacheKeyURL))
+	c.FindProxyForURL(mustParseURL(t, "http://a.example.com/one.html"))
+	c.FindProxyForURL(mustParseURL(t, "http://a.example.com/two.html"))
+	c.FindProxyForURL(mustParseURL(t, "http://a.example.com/one.html"))
+	if f.calls != 2 {
+		t.Errorf("expecting 2 lookups, got %d", f.calls)
+	}
+}
+
+func TestCachingFinderTTL(t *testing.T) {
+	f := &countingFinder{}
+	c := mustCachingFinder(t, f, CacheTTL(time.Minute))
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	in := mustParseURL(t, "http://a.example.com/")
+	c.FindProxyForURL(in)
+	now = now.Add(59 * time.Second)
+	c.FindProxyForURL(in)
+	now = now.Add(time.Second)
+	c.FindProxyForURL(in)
+	if f.calls != 2 {
+		t.Errorf("expecting 2 lookups, got %d", f.calls)
+	}
+}
+
+func TestCachingFinderEvictsLeastRecentlyUsed(t *testing.T) {
+	f := &countingFinder{}
+	c := mustCachingFinder(t, f, CacheSize(2))
+	a := mustParseURL(t, "http://a.example.com/")
+	b := mustParseURL(t, "http://b.example.com/")
+	d := mustParseURL(t, "http://d.example.com/")
+	c.FindProxyForURL(a)
+	c.FindProxyForURL(b)
+	c.FindProxyForURL(a)
+	c.FindProxyForURL(d)
+	c.FindProxyForURL(a)
+	if f.calls != 3 {
+		t.Errorf("expecting 3 lookups, got %d", f.calls)
+	}
+	c.FindProxyForURL(b)
+	if f.calls != 4 {
+		t.Errorf("expecting %q to have been evicted", b)
+	}
+}
+
+func TestCachingFinderDoesNotCacheErrors(t *testing.T) {
+	f := &countingFinder{err: errors.New("boom")}
+	c := mustCachingFinder(t, f)
+	assertFind(t, c, "http://a.example.com/", []Proxy{}, "boom")
+	assertFind(t, c, "http://a.example.com/", []Proxy{}, "boom")
+	if f.calls != 2 {
+		t.Errorf("expecting 2 lookups, got %d", f.calls)
+	}
+}
+
+func TestCachingFinderReloadPurges(t *testing.T) {
+	f := &countingFinder{}
+	c := mustCachingFinder(t, f)
+	assertFind(t, c, "http://a.example.com/", []Proxy{Proxy{ProxyTypeHTTP, "a.example.com", 8080}}, "")
+	if err := c.Reload(); err != nil {
+		t.Fatalf("unexpected error: %q", err)
+	}
+	assertFind(t, c, "http://a.example.com/", []Proxy{Proxy{ProxyTypeHTTP, "a.example.com", 8081}}, "")
+	if f.reloads != 1 || f.calls != 2 {
+		t.Errorf("expecting the reload to purge the cache")
+	}
+}
+
+func TestCachingFinderFailedReloadKeepsCache(t *testing.T) {
+	f := &failingReloadFinder{}
+	c := mustCachingFinder(t, f)
+	c.FindProxyForURL(mustParseURL(t, "http://a.example.com/"))
+	if err := c.Reload(); err == nil {
+		t.Errorf("expecting an error on reload")
+	}
+	if s := c.Stats(); s.Size != 1 {
+		t.Errorf("expecting the cache to be kept, got %+v", s)
+	}
+}
+
+type failingReloadFinder struct {
+	countingFinder
+}
+
+func (f *failingReloadFinder) Reload() error { return errors.New("boom") }
+
+func TestEngineReloadPurgesDNSCache(t *testing.T) {
+	for _, engine := range testEngines {
+		cache := mustDNSCache(t, pacfunc.HostsResolver{})
+		s := stringSettings(DirectPAC)
+		s.resolver = cache
+		e := startEngine(t, engine.new, s)
+		cache.LookupHost(context.Background(), "a.example.com")
+		if err := e.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		if s := cache.Stats(); s.Size != 0 {
+			t.Errorf("%s: expecting the reload to purge the DNS cache, got %+v", engine.name, s)
+		}
+		e.Stop()
+	}
+}
+
+func TestEngineFailedReloadKeepsDNSCache(t *testing.T) {
+	for _, engine := range testEngines {
+		cache := mustDNSCache(t, pacfunc.HostsResolver{})
+		pac := DirectPAC
+		s := stringSettings(DirectPAC)
+		s.loader = func() (string, error) {
+			return pac, nil
+		}
+		s.resolver = cache
+		e := startEngine(t, engine.new, s)
+		cache.LookupHost(context.Background(), "a.example.com")
+		pac = "FindProxyForURL = "
+		if err := e.Reload(); err == nil {
+			t.Errorf("%s: expecting an error on reload", engine.name)
+		}
+		if s := cache.Stats(); s.Size != 1 {
+			t.Errorf("%s: expecting a failed reload to keep the DNS cache, got %+v", engine.name, s)
+		}
+		e.Stop()
+	}
+}
+
+func TestCachingFinderSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		if _, err := NewCachingFinder(&countingFinder{}, CacheSize(size)); err == nil {
+			t.Errorf("expecting an error for a cache size of %d", size)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package pac
+
+import (
+	"log"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BadProxyListOpt used to configure a BadProxyList via the NewBadProxyList func
+type BadProxyListOpt func(*BadProxyList)
+
+// BadProxyRetry sets how long a proxy is considered bad for after its first
+// failure. Each consecutive failure doubles this, up to max.
+func BadProxyRetry(retry, max time.Duration) BadProxyListOpt {
+	return func(l *BadProxyList) {
+		l.retry = retry
+		l.maxRetry = max
+	}
+}
+
+// BadProxyListener is called whenever a proxy is marked as bad, or is
+// healthy again.
+func BadProxyListener(fn func(ProxyHealthEvent)) BadProxyListOpt {
+	return func(l *BadProxyList) {
+		l.listeners = append(l.listeners, fn)
+	}
+}
+
+// NewBadProxyList instance with configuration
+func NewBadProxyList(opts ...BadProxyListOpt) *BadProxyList {
+	l := &BadProxyList{
+		retry:    5 * time.Minute,
+		maxRetry: time.Hour,
+		now:      time.Now,
+		bad:      make(map[Proxy]*BadProxy),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// BadProxyList implements ProxyChecker in the same way that browsers do.
+// Proxies that fail are marked as bad and skipped until their retry time,
+// after which they are given another chance.
+type BadProxyList struct {
+	mutex     sync.RWMutex
+	retry     time.Duration
+	maxRetry  time.Duration
+	listeners []func(ProxyHealthEvent)
+	now       func() time.Time
+	bad       map[Proxy]*BadProxy
+}
+
+// BadProxy is an entry on a BadProxyList
+type BadProxy struct {
+	Proxy     Proxy
+	Failures  int
+	Since     time.Time
+	RetryAt   time.Time
+	LastError error
+}
+
+// ProxyHealthEvent describes a change in the health of a proxy
+type ProxyHealthEvent struct {
+	Proxy    Proxy
+	Healthy  bool
+	Failures int
+	RetryAt  time.Time
+	Reason   error
+}
+
+// IsHealthy returns false while p is marked as bad and its retry time has
+// not yet been reached.
+func (l *BadProxyList) IsHealthy(p Proxy) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	bad, ok := l.bad[p]
+	return !ok || !l.now().Before(bad.RetryAt)
+}
+
+// RecordSuccess takes p off the list
+func (l *BadProxyList) RecordSuccess(p Proxy) {
+	l.mutex.Lock()
+	bad, ok := l.bad[p]
+	if ok {
+		delete(l.bad, p)
+	}
+	l.mutex.Unlock()
+	if ok {
+		log.Printf("proxy %q is healthy again after %d failures", p, bad.Failures)
+		l.notify(ProxyHealthEvent{
+			Proxy:   p,
+			Healthy: true,
+		})
+	}
+}
+
+// RecordFailure marks p as bad, backing off exponentially for each
+// consecutive failure. DIRECT is never marked as bad.
+func (l *BadProxyList) RecordFailure(p Proxy, reason error) {
+	if p == DirectProxy {
+		return
+	}
+	now := l.now()
+	l.mutex.Lock()
+	bad, ok := l.bad[p]
+	if !ok {
+		bad = &BadProxy{
+			Proxy: p,
+			Since: now,
+		}
+		l.bad[p] = bad
+	}
+	bad.Failures++
+	bad.LastError = reason
+	retry := l.retry
+	for i := 1; i < bad.Failures && retry < l.maxRetry; i++ {
+		retry *= 2
+	}
+	if retry > l.maxRetry {
+		retry = l.maxRetry
+	}
+	bad.RetryAt = now.Add(retry)
+	event := ProxyHealthEvent{
+		Proxy:    p,
+		Healthy:  false,
+		Failures: bad.Failures,
+		RetryAt:  bad.RetryAt,
+		Reason:   reason,
+	}
+	l.mutex.Unlock()
+	log.Printf("proxy %q marked as bad for %s after %d failures: %s", p, retry, event.Failures, reason)
+	l.notify(event)
+}
+
+// ResetRecord takes p off the list without it being considered a success
+func (l *BadProxyList) ResetRecord(p Proxy) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.bad, p)
+}
+
+// ResetAll empties the list
+func (l *BadProxyList) ResetAll() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.bad = make(map[Proxy]*BadProxy)
+}
+
+// BadProxies returns a snapshot of the list, oldest first
+func (l *BadProxyList) BadProxies() []BadProxy {
+	l.mutex.RLock()
+	list := make([]BadProxy, 0, len(l.bad))
+	for _, bad := range l.bad {
+		list = append(list, *bad)
+	}
+	l.mutex.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Since.Before(list[j].Since)
+	})
+	return list
+}
+
+func (l *BadProxyList) notify(event ProxyHealthEvent) {
+	for _, fn := range l.listeners {
+		fn(event)
+	}
+}
+
+// CheckedSelector prefers proxies that the Checker considers healthy.
+// Only when none of them are will it select from the unhealthy ones.
+type CheckedSelector struct {
+	Selector ProxySelector
+	Checker  ProxyChecker
+}
+
+// SelectProxy using the Selector, from only the proxies that the Checker
+// considers healthy unless none of them are.
+func (s *CheckedSelector) SelectProxy(from Proxies) Proxy {
+	healthy := make(Proxies, 0, len(from))
+	for _, p := range from {
+		if s.Checker.IsHealthy(p) {
+			healthy = append(healthy, p)
+		}
+	}
+	if len(healthy) == 0 {
+		return s.Selector.SelectProxy(from)
+	}
+	return s.Selector.SelectProxy(healthy)
+}
+
+// OrderProxies as the Selector would, but with any unhealthy proxies moved
+// to the end.
+func (s *CheckedSelector) OrderProxies(in *url.URL, from Proxies) Proxies {
+	ordered := OrderProxies(s.Selector, in, from)
+	healthy := make(Proxies, 0, len(ordered))
+	var unhealthy Proxies
+	for _, p := range ordered {
+		if s.Checker.IsHealthy(p) {
+			healthy = append(healthy, p)
+		} else {
+			unhealthy = append(unhealthy, p)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
@@ -0,0 +1,110 @@
+package pac
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBadProxyListBackoff(t *testing.T) {
+	var events []ProxyHealthEvent
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewBadProxyList(
+		BadProxyRetry(time.Minute, 5*time.Minute),
+		BadProxyListener(func(e ProxyHealthEvent) {
+			events = append(events, e)
+		}),
+	)
+	l.now = func() time.Time { return now }
+	p := Proxy{ProxyTypeHTTP, "proxy.example.com", 8080}
+
+	if !l.IsHealthy(p) {
+		t.Fatalf("expecting %q to start off healthy", p)
+	}
+	for i, backoff := range []time.Duration{1, 2, 4, 5, 5} {
+		l.RecordFailure(p, errors.New("connection refused"))
+		backoff *= time.Minute
+		if l.IsHealthy(p) {
+			t.Errorf("failure %d, expecting %q to be unhealthy", i+1, p)
+		}
+		now = now.Add(backoff - time.Second)
+		if l.IsHealthy(p) {
+			t.Errorf("failure %d, expecting %q to be unhealthy before %s", i+1, p, backoff)
+		}
+		now = now.Add(time.Second)
+		if !l.IsHealthy(p) {
+			t.Errorf("failure %d, expecting %q to be retried after %s", i+1, p, backoff)
+		}
+	}
+	if bad := l.BadProxies(); len(bad) != 1 || bad[0].Failures != 5 || bad[0].LastError.Error() != "connection refused" {
+		t.Errorf("unexpected bad proxy list %v", bad)
+	}
+
+	l.RecordSuccess(p)
+	if !l.IsHealthy(p) || len(l.BadProxies()) != 0 {
+		t.Errorf("expecting %q to be healthy after a success", p)
+	}
+	if len(events) != 6 {
+		t.Fatalf("expecting 6 events, got %d", len(events))
+	}
+	if e := events[4]; e.Healthy || e.Failures != 5 || e.Reason == nil {
+		t.Errorf("unexpected failure event %v", e)
+	}
+	if e := events[5]; !e.Healthy || e.Proxy != p {
+		t.Errorf("unexpected success event %v", e)
+	}
+
+	l.RecordFailure(p, errors.New("connection refused"))
+	if l.IsHealthy(p) {
+		t.Errorf("expecting the backoff for %q to start again after a success", p)
+	}
+	now = now.Add(time.Minute)
+	if !l.IsHealthy(p) {
+		t.Errorf("expecting the backoff for %q to start again after a success", p)
+	}
+}
+
+func TestBadProxyListIgnoresDirect(t *testing.T) {
+	l := NewBadProxyList()
+	l.RecordFailure(DirectProxy, errors.New("no route to host"))
+	if !l.IsHealthy(DirectProxy) {
+		t.Error("expecting DIRECT to never be marked as bad")
+	}
+}
+
+func TestBadProxyListReset(t *testing.T) {
+	a := Proxy{ProxyTypeHTTP, "a.example.com", 8080}
+	b := Proxy{ProxyTypeHTTP, "b.example.com", 8080}
+	l := NewBadProxyList()
+	l.RecordFailure(a, errors.New("a"))
+	l.RecordFailure(b, errors.New("b"))
+	l.ResetRecord(a)
+	if !l.IsHealthy(a) || l.IsHealthy(b) {
+		t.Errorf("expecting only %q to be reset", a)
+	}
+	l.ResetAll()
+	if !l.IsHealthy(b) {
+		t.Errorf("expecting %q to be reset", b)
+	}
+}
+
+func TestCheckedSelector(t *testing.T) {
+	a := Proxy{ProxyTypeHTTP, "a.example.com", 8080}
+	b := Proxy{ProxyTypeHTTP, "b.example.com", 8080}
+	l := NewBadProxyList()
+	s := &CheckedSelector{
+		Selector: &FirstItemSelector{},
+		Checker:  l,
+	}
+	if p := s.SelectProxy(Proxies{a, b}); p != a {
+		t.Errorf("expecting %q, got %q", a, p)
+	}
+	l.RecordFailure(a, errors.New("a"))
+	if p := s.SelectProxy(Proxies{a, b}); p != b {
+		t.Errorf("expecting %q, got %q", b, p)
+	}
+	l.RecordFailure(b, errors.New("b"))
+	if p := s.SelectProxy(Proxies{a, b}); p != a {
+		t.Errorf("expecting %q when everything is bad, got %q", a, p)
+	}
+}
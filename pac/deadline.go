@@ -0,0 +1,65 @@
+package pac
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrTimeout is returned, wrapped, when a PAC takes too long to evaluate
+var ErrTimeout = errors.New("PAC evaluation timed out")
+
+// withDeadline runs fn, calling interrupt and returning ErrTimeout if it has
+// not finished within timeout. fn is left to finish in the background, so it
+// must not touch anything that the caller goes on to use.
+//
+// release, when not nil, is called once fn has finished and interrupt can no
+// longer be called, so that whatever fn was using can be handed on. After a
+// timeout that happens in the background, once fn gives up.
+func withDeadline(timeout time.Duration, interrupt func(), fn func() error, release func()) error {
+	if release == nil {
+		release = func() {}
+	}
+	if timeout <= 0 {
+		defer release()
+		return fn()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		release()
+		return err
+	case <-timer.C:
+		interrupt()
+		go func() {
+			<-done
+			release()
+		}()
+		return ErrTimeout
+	}
+}
+
+// afterTimeout returns a channel that receives once timeout has passed, or
+// nil, which never receives, when there is no timeout. stop releases the
+// timer.
+func afterTimeout(timeout time.Duration) (c <-chan time.Time, stop func() bool) {
+	if timeout <= 0 {
+		return nil, func() bool { return false }
+	}
+	timer := time.NewTimer(timeout)
+	return timer.C, timer.Stop
+}
+
+// remainingTimeout returns how much of timeout is left since start, and false
+// once it has run out. Without a timeout there is always time left.
+func remainingTimeout(start time.Time, timeout time.Duration) (time.Duration, bool) {
+	if timeout <= 0 {
+		return timeout, true
+	}
+	left := timeout - time.Since(start)
+	return left, left > 0
+}
@@ -0,0 +1,445 @@
+package pac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/williambailey/pacproxy/pacfunc"
+)
+
+// engineSettings are what each engine is configured with by the shared
+// engine tests, zero values leave the engine's default
+type engineSettings struct {
+	loader       Loader
+	poolSize     int
+	evalTimeout  time.Duration
+	startTimeout time.Duration
+	fallback     Proxies
+	resolver     pacfunc.Resolver
+	nower        pacfunc.Nower
+	location     *time.Location
+	commit       func(pac string)
+}
+
+func stringSettings(pac string) engineSettings {
+	return engineSettings{
+		loader: func() (string, error) {
+			return pac, nil
+		},
+	}
+}
+
+// testEngines are each run through every one of the engineTests
+var testEngines = []struct {
+	name string
+	new  func(s engineSettings) Engine
+}{
+	{
+		"Otto",
+		func(s engineSettings) Engine {
+			opts := []OttoEngineOpt{
+				OttoEvalTimeout(s.evalTimeout),
+				OttoStartTimeout(s.startTimeout),
+				OttoFallback(s.fallback),
+				OttoResolver(s.resolver),
+				OttoNower(s.nower),
+				OttoLocation(s.location),
+				OttoCommit(s.commit),
+			}
+			if s.loader != nil {
+				opts = append(opts, OttoLoader(s.loader))
+			}
+			if s.poolSize > 0 {
+				opts = append(opts, OttoPoolSize(s.poolSize))
+			}
+			return NewOttoEngine(opts...)
+		},
+	},
+	{
+		"Goja",
+		func(s engineSettings) Engine {
+			opts := []GojaEngineOpt{
+				GojaEvalTimeout(s.evalTimeout),
+				GojaStartTimeout(s.startTimeout),
+				GojaFallback(s.fallback),
+				GojaResolver(s.resolver),
+				GojaNower(s.nower),
+				GojaLocation(s.location),
+				GojaCommit(s.commit),
+			}
+			if s.loader != nil {
+				opts = append(opts, GojaLoader(s.loader))
+			}
+			if s.poolSize > 0 {
+				opts = append(opts, GojaPoolSize(s.poolSize))
+			}
+			return NewGojaEngine(opts...)
+		},
+	},
+}
+
+// startEngine or fail the test
+func startEngine(t *testing.T, newEngine func(engineSettings) Engine, s engineSettings) Engine {
+	e := newEngine(s)
+	if err := e.Start(); err != nil {
+		t.Fatalf("failed to start: %q", err)
+	}
+	return e
+}
+
+var engineFindTests = []struct {
+	name    string
+	pac     string
+	url     string
+	proxies []Proxy
+	err     string
+}{
+	{
+		"DirectPAC",
+		DirectPAC,
+		"http://www.example.com/page.html",
+		[]Proxy{DirectProxy},
+		"",
+	},
+	{
+		"MultipleValues",
+		"function FindProxyForURL(url, host){ return 'PROXY proxy.example.com:8080; DIRECT'; }",
+		"http://www.example.com/page.html",
+		[]Proxy{Proxy{ProxyTypeHTTP, "proxy.example.com", 8080}, DirectProxy},
+		"",
+	},
+	{
+		"InvalidValue",
+		"function FindProxyForURL(url, host){ return 1234; }",
+		"http://www.example.com/page.html",
+		[]Proxy{},
+		"unsupported PAC command \"1234\"",
+	},
+	{
+		"PrefersFindProxyForURLEx",
+		`function FindProxyForURL(url, host){ return "DIRECT"; }
+function FindProxyForURLEx(url, host){ return "PROXY proxy.example.com:8080"; }`,
+		"http://www.example.com/page.html",
+		[]Proxy{Proxy{ProxyTypeHTTP, "proxy.example.com", 8080}},
+		"",
+	},
+	{
+		"NonFunctionFindProxyForURLEx",
+		`function FindProxyForURL(url, host){ return "DIRECT"; }
+var FindProxyForURLEx = "PROXY proxy.example.com:8080";`,
+		"http://www.example.com/page.html",
+		[]Proxy{DirectProxy},
+		"",
+	},
+	{
+		"Builtins",
+		`function FindProxyForURL(url, host){
+	if (isPlainHostName(host) || !shExpMatch(url, "http://*") || dnsDomainLevels(host) != 2) {
+		return "DIRECT";
+	}
+	if (isInNet("10.1.2.3", "10.0.0.0", "255.0.0.0") && localHostOrDomainIs(host, "www.example.com") && convert_addr("10.0.0.1") == 167772161) {
+		return "PROXY proxy.example.com:8080";
+	}
+	return "DIRECT";
+}`,
+		"http://www.example.com/page.html",
+		[]Proxy{Proxy{ProxyTypeHTTP, "proxy.example.com", 8080}},
+		"",
+	},
+	{
+		"IPv6Builtins",
+		`function FindProxyForURLEx(url, host){
+	if (getClientVersion() != "1.0" || !isResolvableEx("localhost") || dnsResolveEx("127.0.0.1") != "127.0.0.1" || typeof myIpAddressEx() != "string") {
+		return "DIRECT";
+	}
+	if (sortIpAddressList("10.0.0.1;::1") == "::1;10.0.0.1" && sortIpAddressList("nope") === false && isInNetEx("3ffe:8311:ffff::1", "3ffe:8311:ffff::/48")) {
+		return "PROXY proxy.example.com:8080";
+	}
+	return "DIRECT";
+}`,
+		"http://www.example.com/page.html",
+		[]Proxy{Proxy{ProxyTypeHTTP, "proxy.example.com", 8080}},
+		"",
+	},
+}
+
+var engineTests = []struct {
+	name string
+	test func(t *testing.T, name string, newEngine func(engineSettings) Engine)
+}{
+	{"FindProxyForURL", testEngineFindProxyForURL},
+	{"WithoutPac", testEngineWithoutPac},
+	{"NotStarted", testEngineNotStarted},
+	{"PoolEvaluatesInParallel", testEnginePoolEvaluatesInParallel},
+	{"ReloadSwapsPool", testEngineReloadSwapsPool},
+	{"ReloadKeepsCurrentPACOnFailure", testEngineReloadKeepsCurrentPACOnFailure},
+	{"StartWithoutFindProxyForURL", testEngineStartWithoutFindProxyForURL},
+	{"ReloadWithoutFindProxyForURL", testEngineReloadWithoutFindProxyForURL},
+	{"EvalTimeout", testEngineEvalTimeout},
+	{"EvalTimeoutWithBusyPool", testEngineEvalTimeoutWithBusyPool},
+	{"StartTimeout", testEngineStartTimeout},
+	{"Resolver", testEngineResolver},
+	{"Clock", testEngineClock},
+}
+
+func TestEngines(t *testing.T) {
+	for _, engine := range testEngines {
+		for _, tt := range engineTests {
+			engine, tt := engine, tt
+			t.Run(engine.name+"/"+tt.name, func(t *testing.T) {
+				tt.test(t, engine.name, engine.new)
+			})
+		}
+	}
+}
+
+func testEngineFindProxyForURL(t *testing.T, name string, newEngine func(engineSettings) Engine) {
+	for _, tt := range engineFindTests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := startEngine(t, newEngine, stringSettings(tt.pac))
+			defer e.Stop()
+			assertFind(t, e, tt.url, tt.proxies, tt.err)
+		})
+	}
+}
+
+func testEngineWithoutPac(t *testing.T, name string, newEngine func(engineSettings) Engine) {
+	err := newEngine(engineSettings{}).Start()
+	e := "pac loader has not been configured"
+	if err == nil || err.Error() != e {
+		t.Errorf("expecting error %q, got %v", e, err)
+	}
+}
+
+func testEngineNotStarted(t *testing.T, name string, newEngine func(engineSettings) Engine) {
+	assertFind(t, newEngine(engineSettings{}), "http://www.example.com/", []Proxy{}, name+"Engine has not been started")
+}
+
+func testEnginePoolEvaluatesInParallel(t *testing.T, name string, newEngine func(engineSettings) Engine) {
+	s := stringSettings("function FindProxyForURL(url, host){ return 'PROXY ' + host + ':8080'; }")
+	s.poolSize = 4
+	e := startEngine(t, newEngine, s)
+	defer e.Stop()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			host := fmt.Sprintf("host%d.example.com", i)
+			assertFind(t, e, "http://"+host+"/", []Proxy{Proxy{ProxyTypeHTTP, host, 8080}}, "")
+		}(i)
+	}
+	wg.Wait()
+}
+
+func testEngineReloadSwapsPool(t *testing.T, name string, newEngine func(engineSettings) Engine) {
+	pac := "function FindProxyForURL(url, host){ return 'DIRECT'; }"
+	e := startEngine(t, newEngine, engineSettings{
+		loader: func() (string, error) {
+			return pac, nil
+		},
+		poolSize: 2,
+	})
+	defer e.Stop()
+	assertFind(t, e, "http://www.example.com/", []Proxy{DirectProxy}, "")
+	pac = "function FindProxyForURL(url, host){ return 'PROXY proxy.example.com:8080'; }"
+	if err := e.Reload(); err != nil {
+		t.Fatalf("failed to reload: %q", err)
+	}
+	for i := 0; i < 2; i++ {
+		assertFind(t, e, "http://www.example.com/", []Proxy{Proxy{ProxyTypeHTTP, "proxy.example.com", 8080}}, "")
+	}
+}
+
+func testEngineReloadKeepsCurrentPACOnFailure(t *testing.T, name string, newEngine func(engineSettings) Engine) {
+	pac := "function FindProxyForURL(url, host){ return 'DIRECT'; }"
+	e := startEngine(t, newEngine, engineSettings{
+		loader: func() (string, error) {
+			return pac, nil
+		},
+	})
+	defer e.Stop()
+	pac = "function FindProxyForURL(url, host){ return 'DIRECT'"
+	if err := e.Reload(); err == nil {
+		t.Errorf("expecting an error on reload")
+	}
+	assertFind(t, e, "http://www.example.com/", []Proxy{DirectProxy}, "")
+}
+
+// engineUnusablePACs run without error but don't define FindProxyForURL as
+// a function, so can't be used
+var engineUnusablePACs = []struct {
+	name string
+	pac  string
+	err  string
+}{
+	{"Undefined", "1 + 1", "ReferenceError: 'FindProxyForURL' is not defined"},
+	{"NonFunction", "FindProxyForURL = 1234", "TypeError: 'FindProxyForURL' is not a function"},
+	{"NonFunctionEx", "var FindProxyForURLEx = 'DIRECT'", "ReferenceError: 'FindProxyForURL' is not defined"},
+}
+
+func testEngineStartWithoutFindProxyForURL(t *testing.T, name string, newEngine func(engineSettings) Engine) {
+	for _, tt := range engineUnusablePACs {
+		err := newEngine(stringSettings(tt.pac)).Start()
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%s: expecting error %q on start, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func testEngineReloadWithoutFindProxyForURL(t *testing.T, name string, newEngine func(engineSettings) Engine) {
+	for _, tt := range engineUnusablePACs {
+		pac := "function FindProxyForURL(url, host){ return 'DIRECT'; }"
+		e := startEngine(t, newEngine, engineSettings{
+			loader: func() (string, error) {
+				return pac, nil
+			},
+		})
+		pac = tt.pac
+		if err := e.Reload(); err == nil || err.Error() != tt.err {
+			t.Errorf("%s: expecting error %q on reload, got %v", tt.name, tt.err, err)
+		}
+		assertFind(t, e, "http://www.example.com/", []Proxy{DirectProxy}, "")
+		e.Stop()
+	}
+}
+
+func testEngineEvalTimeout(t *testing.T, name string, newEngine func(engineSettings) Engine) {
+	s := stringSettings("function FindProxyForURL(url, host){ if (host == 'loop') { while (true) {} } return 'DIRECT'; }")
+	s.poolSize = 1
+	s.evalTimeout = 50 * time.Millisecond
+	s.fallback = Proxies{Proxy{ProxyTypeHTTP, "fallback.example.com", 8080}}
+	e := startEngine(t, newEngine, s)
+	defer e.Stop()
+	assertFind(
+		t,
+		e,
+		"http://loop/",
+		[]Proxy{Proxy{ProxyTypeHTTP, "fallback.example.com", 8080}},
+		"PAC evaluation timed out: FindProxyForURL(\"http://loop/\") took longer than 50ms",
+	)
+	// the interrupted VM should be usable again
+	assertFind(t, e, "http://www.example.com/", []Proxy{DirectProxy}, "")
+}
+
+// blockingResolver blocks lookups of host until release is closed
+type blockingResolver struct {
+	host    string
+	release chan struct{}
+}
+
+func (r blockingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if host == r.host {
+		<-r.release
+	}
+	return []string{"192.0.2.1"}, nil
+}
+
+func testEngineEvalTimeoutWithBusyPool(t *testing.T, name string, newEngine func(engineSettings) Engine) {
+	s := stringSettings("function FindProxyForURL(url, host){ if (host == 'blocked') { dnsResolve(host); } return 'DIRECT'; }")
+	s.poolSize = 1
+	s.evalTimeout = 50 * time.Millisecond
+	s.fallback = Proxies{Proxy{ProxyTypeHTTP, "fallback.example.com", 8080}}
+	r := blockingResolver{host: "blocked", release: make(chan struct{})}
+	s.resolver = r
+	e := startEngine(t, newEngine, s)
+	defer e.Stop()
+	// the builtin can't be interrupted, so the only VM stays in use
+	assertFind(
+		t,
+		e,
+		"http://blocked/",
+		[]Proxy{Proxy{ProxyTypeHTTP, "fallback.example.com", 8080}},
+		"PAC evaluation timed out: FindProxyForURL(\"http://blocked/\") took longer than 50ms",
+	)
+	assertFind(
+		t,
+		e,
+		"http://www.example.com/",
+		[]Proxy{Proxy{ProxyTypeHTTP, "fallback.example.com", 8080}},
+		"PAC evaluation timed out: FindProxyForURL(\"http://www.example.com/\") took longer than 50ms",
+	)
+	// once the builtin returns the VM goes back to the pool without the
+	// interrupt that was meant for the blocked lookup
+	close(r.release)
+	u, _ := url.Parse("http://www.example.com/")
+	for i := 0; i < 20; i++ {
+		if _, err := e.FindProxyForURL(u); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		assertFind(t, e, "http://www.example.com/", []Proxy{DirectProxy}, "")
+	}
+}
+
+func testEngineStartTimeout(t *testing.T, name string, newEngine func(engineSettings) Engine) {
+	s := stringSettings("while (true) {}")
+	s.startTimeout = 50 * time.Millisecond
+	if err := newEngine(s).Start(); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expecting a timeout error, got %v", err)
+	}
+}
+
+func testEngineResolver(t *testing.T, name string, newEngine func(engineSettings) Engine) {
+	s := stringSettings(`function FindProxyForURL(url, host){
+	if (isResolvable(host) && dnsResolve(host) == "192.0.2.1" && isInNet(host, "192.0.2.0", "255.255.255.0") && dnsResolveEx(host) == "2001:db8::1;192.0.2.1") {
+		return "PROXY proxy.example.com:8080";
+	}
+	return "DIRECT";
+}`)
+	s.resolver = pacfunc.HostsResolver{
+		Hosts: map[string][]string{
+			"static.example.com": {"2001:db8::1", "192.0.2.1"},
+		},
+	}
+	e := startEngine(t, newEngine, s)
+	defer e.Stop()
+	assertFind(t, e, "http://static.example.com/", []Proxy{Proxy{ProxyTypeHTTP, "proxy.example.com", 8080}}, "")
+	assertFind(t, e, "http://other.example.com/", []Proxy{DirectProxy}, "")
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+	s = stringSettings(`function FindProxyForURL(url, host){
+	if (myIpAddress() == "192.0.2.1" && myIpAddressEx() == "2001:db8::1;192.0.2.1") {
+		return "PROXY proxy.example.com:8080";
+	}
+	return "DIRECT";
+}`)
+	s.resolver = pacfunc.HostsResolver{
+		Hosts: map[string][]string{
+			strings.ToLower(hostname): {"2001:db8::1", "192.0.2.1"},
+		},
+	}
+	e = startEngine(t, newEngine, s)
+	defer e.Stop()
+	assertFind(t, e, "http://www.example.com/", []Proxy{Proxy{ProxyTypeHTTP, "proxy.example.com", 8080}}, "")
+}
+
+func testEngineClock(t *testing.T, name string, newEngine func(engineSettings) Engine) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	s := stringSettings(`function FindProxyForURL(url, host){
+	if (weekdayRange("SUN") && weekdayRange("MON", "GMT") && dateRange(31, "DEC", 2017) && timeRange(19, 20) && timeRange(0, "GMT")) {
+		return "PROXY proxy.example.com:8080";
+	}
+	return "DIRECT";
+}`)
+	s.nower = pacfunc.NewStaticNower(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	s.location = ny
+	e := startEngine(t, newEngine, s)
+	defer e.Stop()
+	assertFind(t, e, "http://www.example.com/", []Proxy{Proxy{ProxyTypeHTTP, "proxy.example.com", 8080}}, "")
+}
@@ -0,0 +1,499 @@
+package pac
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/williambailey/pacproxy/pacfunc"
+)
+
+// GojaEngineOpt used to configure a GojaEngine via the NewGojaEngine func
+type GojaEngineOpt func(*GojaEngine)
+
+// GojaLoader that the engine should use
+func GojaLoader(fn Loader) GojaEngineOpt {
+	return func(g *GojaEngine) {
+		g.loader = fn
+	}
+}
+
+// GojaPoolSize sets how many VMs are loaded with the PAC so that lookups
+// can be evaluated in parallel
+func GojaPoolSize(n int) GojaEngineOpt {
+	return func(g *GojaEngine) {
+		g.poolSize = n
+	}
+}
+
+// GojaEvalTimeout sets how long each FindProxyForURL call may take before it
+// is interrupted
+func GojaEvalTimeout(d time.Duration) GojaEngineOpt {
+	return func(g *GojaEngine) {
+		g.evalTimeout = d
+	}
+}
+
+// GojaStartTimeout sets how long running the PAC, when the engine is started
+// or reloaded, may take before it is interrupted
+func GojaStartTimeout(d time.Duration) GojaEngineOpt {
+	return func(g *GojaEngine) {
+		g.startTimeout = d
+	}
+}
+
+// GojaFallback sets the result that FindProxyForURL returns, along with the
+// error, when it is interrupted
+func GojaFallback(p Proxies) GojaEngineOpt {
+	return func(g *GojaEngine) {
+		g.fallback = p
+	}
+}
+
+// GojaResolver sets the resolver that the PAC DNS functions use. When it is a
+// pacfunc.DNSCache it is purged whenever the engine is reloaded.
+func GojaResolver(r pacfunc.Resolver) GojaEngineOpt {
+	return func(g *GojaEngine) {
+		g.dns = pacfunc.DNS{Resolver: r}
+	}
+}
+
+// GojaNower sets what the PAC date and time functions use to get the
+// current time
+func GojaNower(n pacfunc.Nower) GojaEngineOpt {
+	return func(g *GojaEngine) {
+		g.clock.Nower = n
+	}
+}
+
+// GojaLocation sets the time zone that the PAC date and time functions use
+// when they are not asked for GMT, instead of the local one
+func GojaLocation(loc *time.Location) GojaEngineOpt {
+	return func(g *GojaEngine) {
+		g.clock.Location = loc
+	}
+}
+
+// GojaCommit sets a func that is called with the PAC each time the engine is
+// started or reloaded with it, once it is in use. fn must not use the
+// engine.
+func GojaCommit(fn func(pac string)) GojaEngineOpt {
+	return func(g *GojaEngine) {
+		g.commit = fn
+	}
+}
+
+// GojaStringLoader implements a string loader
+func GojaStringLoader(pac string) GojaEngineOpt {
+	return GojaLoader(func() (string, error) {
+		return pac, nil
+	})
+}
+
+// NewGojaEngine instance with configuration
+func NewGojaEngine(opts ...GojaEngineOpt) *GojaEngine {
+	g := &GojaEngine{
+		mutex: &sync.RWMutex{},
+		loader: func() (string, error) {
+			return "", errors.New("pac loader has not been configured")
+		},
+		poolSize: runtime.NumCPU(),
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	if g.poolSize < 1 {
+		g.poolSize = 1
+	}
+	return g
+}
+
+// GojaEngine struct, an ES2015+ alternative to OttoEngine
+type GojaEngine struct {
+	mutex        *sync.RWMutex
+	loader       Loader
+	poolSize     int
+	evalTimeout  time.Duration
+	startTimeout time.Duration
+	fallback     Proxies
+	dns          pacfunc.DNS
+	clock        pacfunc.Clock
+	commit       func(pac string)
+	isStarted    bool
+	pool         chan *goja.Runtime
+}
+
+func (g *GojaEngine) Start() error {
+	defer func() {
+		g.mutex.RLock()
+		defer g.mutex.RUnlock()
+		if g.isStarted {
+			log.Print("started GojaEngine")
+		} else {
+			log.Print("failed to start GojaEngine")
+		}
+	}()
+	g.mutex.RLock()
+	if g.isStarted {
+		defer g.mutex.RUnlock()
+		return nil
+	}
+	g.mutex.RUnlock()
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.isStarted {
+		return nil
+	}
+	log.Print("initialising GojaEngine")
+	pool, pac, err := g.newPool()
+	if err != nil {
+		return err
+	}
+	g.pool = pool
+	g.isStarted = true
+	if g.commit != nil {
+		g.commit(pac)
+	}
+
+	return nil
+}
+
+// newPool loads the PAC once and runs it in each of a new set of VMs, failing
+// if the PAC does not define FindProxyForURL as a function
+func (g *GojaEngine) newPool() (chan *goja.Runtime, string, error) {
+	pac, err := g.loader()
+	if err != nil {
+		return nil, "", err
+	}
+	log.Print("PAC:\n" + pac + "\n")
+	program, err := goja.Compile("", pac, false)
+	if err != nil {
+		return nil, "", err
+	}
+	pool := make(chan *goja.Runtime, g.poolSize)
+	for i := 0; i < g.poolSize; i++ {
+		vm, err := newGojaVM(program, g.startTimeout, g.dns, g.clock)
+		if err != nil {
+			return nil, "", err
+		}
+		// A PAC that runs but can't be used must not replace one that can.
+		if _, err := gojaFindProxyFunc(vm); err != nil {
+			return nil, "", err
+		}
+		pool <- vm
+	}
+	return pool, pac, nil
+}
+
+func newGojaVM(program *goja.Program, timeout time.Duration, dns pacfunc.DNS, clock pacfunc.Clock) (*goja.Runtime, error) {
+	vm := goja.New()
+
+	// ConvertAddr(ipaddr string)
+	vm.Set("convert_addr", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(pacfunc.ConvertAddr(call.Argument(0).String()))
+	})
+
+	// DNSDomainIs(host, domain string) bool
+	vm.Set("dnsDomainIs", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(pacfunc.DNSDomainIs(call.Argument(0).String(), call.Argument(1).String()))
+	})
+
+	// ShExpMatch(str, shexp string) bool
+	vm.Set("shExpMatch", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(pacfunc.ShExpMatch(call.Argument(0).String(), call.Argument(1).String()))
+	})
+
+	// IsInNet(host, netip, netmask string) bool
+	vm.Set("isInNet", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(dns.IsInNet(call.Argument(0).String(), call.Argument(1).String(), call.Argument(2).String()))
+	})
+
+	// MyIPAddress() string
+	vm.Set("myIpAddress", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(dns.MyIPAddress())
+	})
+
+	// DNSResolve(host string) string
+	vm.Set("dnsResolve", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(dns.DNSResolve(call.Argument(0).String()))
+	})
+
+	// IsPlainHostName(host string) bool
+	vm.Set("isPlainHostName", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(pacfunc.IsPlainHostName(call.Argument(0).String()))
+	})
+
+	// LocalHostOrDomainIs(host, hostdom string) bool
+	vm.Set("localHostOrDomainIs", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(pacfunc.LocalHostOrDomainIs(call.Argument(0).String(), call.Argument(1).String()))
+	})
+
+	// IsResolvable(host string) bool
+	vm.Set("isResolvable", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(dns.IsResolvable(call.Argument(0).String()))
+	})
+
+	// DNSDomainLevels(host string) int
+	vm.Set("dnsDomainLevels", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(pacfunc.DNSDomainLevels(call.Argument(0).String()))
+	})
+
+	// WeekdayRange(wd1, wd2, gmt string) bool
+	vm.Set("weekdayRange", func(call goja.FunctionCall) goja.Value {
+		args := gojaStringArgs(call, 3)
+		return vm.ToValue(clock.WeekdayRange(args[0], args[1], args[2]))
+	})
+
+	// DateRange(args []string) bool
+	vm.Set("dateRange", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(clock.DateRange(gojaStringArgs(call, len(call.Arguments))))
+	})
+
+	// TimeRange(args []string) bool
+	vm.Set("timeRange", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(clock.TimeRange(gojaStringArgs(call, len(call.Arguments))))
+	})
+
+	// IsInNetEx(ipaddr, ipprefix string) bool
+	vm.Set("isInNetEx", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(pacfunc.IsInNetEx(call.Argument(0).String(), call.Argument(1).String()))
+	})
+
+	// MyIPAddressEx() string
+	vm.Set("myIpAddressEx", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(dns.MyIPAddressEx())
+	})
+
+	// DNSResolveEx(host string) string
+	vm.Set("dnsResolveEx", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(dns.DNSResolveEx(call.Argument(0).String()))
+	})
+
+	// IsResolvableEx(host string) bool
+	vm.Set("isResolvableEx", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(dns.IsResolvableEx(call.Argument(0).String()))
+	})
+
+	// SortIPAddressList(list string) (string, bool)
+	vm.Set("sortIpAddressList", func(call goja.FunctionCall) goja.Value {
+		sorted, ok := pacfunc.SortIPAddressList(call.Argument(0).String())
+		if !ok {
+			return vm.ToValue(false)
+		}
+		return vm.ToValue(sorted)
+	})
+
+	// GetClientVersion() string
+	vm.Set("getClientVersion", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(pacfunc.GetClientVersion())
+	})
+
+	err := runGoja(vm, timeout, func() error {
+		_, err := vm.RunProgram(program)
+		return err
+	}, nil)
+	if errors.Is(err, ErrTimeout) {
+		return nil, fmt.Errorf("%w: running the PAC took longer than %s", ErrTimeout, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return vm, nil
+}
+
+// runGoja calls fn, which should use vm, interrupting vm and returning
+// ErrTimeout if it takes longer than timeout. release, when not nil, is
+// called once vm is finished with and can no longer be interrupted, with any
+// interrupt that came too late to stop fn cleared.
+func runGoja(vm *goja.Runtime, timeout time.Duration, fn func() error, release func()) error {
+	vm.ClearInterrupt()
+	err := withDeadline(
+		timeout,
+		func() {
+			vm.Interrupt(ErrTimeout)
+		},
+		fn,
+		func() {
+			vm.ClearInterrupt()
+			if release != nil {
+				release()
+			}
+		},
+	)
+	var interrupted *goja.InterruptedError
+	if errors.As(err, &interrupted) {
+		return ErrTimeout
+	}
+	return err
+}
+
+// ValidateGoja implements Validator using a GojaEngine with the default
+// configuration
+func ValidateGoja(name, pac string) error {
+	return NewGojaEngine().Validate(name, pac)
+}
+
+// Validate implements Validator, checking that pac runs in a VM configured
+// as the engine's are and that it defines FindProxyForURL
+func (g *GojaEngine) Validate(name, pac string) error {
+	program, err := goja.Compile(name, pac, false)
+	if err != nil {
+		return err
+	}
+	vm, err := newGojaVM(program, g.startTimeout, g.dns, g.clock)
+	if err != nil {
+		return err
+	}
+	_, err = gojaFindProxyFunc(vm)
+	return err
+}
+
+// gojaStringArgs returns the first n arguments as strings, with any that are
+// undefined as ""
+func gojaStringArgs(call goja.FunctionCall, n int) []string {
+	args := make([]string, n)
+	for i := range args {
+		if v := call.Argument(i); !goja.IsUndefined(v) {
+			args[i] = v.String()
+		}
+	}
+	return args
+}
+
+func (g *GojaEngine) Stop() error {
+	defer func() {
+		g.mutex.RLock()
+		defer g.mutex.RUnlock()
+		if !g.isStarted {
+			log.Print("stopped GojaEngine")
+		} else {
+			log.Print("failed to stop GojaEngine")
+		}
+	}()
+	g.mutex.RLock()
+	if !g.isStarted {
+		defer g.mutex.RUnlock()
+		return nil
+	}
+	g.mutex.RUnlock()
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if !g.isStarted {
+		return nil
+	}
+	log.Print("stopping GojaEngine")
+	g.pool = nil
+	g.isStarted = false
+	return nil
+}
+
+// Reload loads a new pool of VMs and then swaps it for the current one, so
+// lookups are never evaluated against a partially loaded pool. If the new
+// PAC fails to load the current one is kept, along with any cached DNS
+// lookups; otherwise they are purged once the new pool is in use.
+func (g *GojaEngine) Reload() error {
+	g.mutex.RLock()
+	isStarted := g.isStarted
+	g.mutex.RUnlock()
+	if !isStarted {
+		return g.Start()
+	}
+	log.Print("reloading GojaEngine")
+	pool, pac, err := g.newPool()
+	if err != nil {
+		log.Print("failed to reload GojaEngine, keeping the current PAC")
+		return err
+	}
+	g.mutex.Lock()
+	g.pool = pool
+	g.mutex.Unlock()
+	purgeDNSCache(g.dns)
+	if g.commit != nil {
+		g.commit(pac)
+	}
+	log.Print("reloaded GojaEngine")
+	return nil
+}
+
+func (g *GojaEngine) FindProxyForURL(in *url.URL) (Proxies, error) {
+	g.mutex.RLock()
+	pool := g.pool
+	g.mutex.RUnlock()
+	if pool == nil {
+		return Proxies{}, errors.New("GojaEngine has not been started")
+	}
+
+	// Waiting for a free VM counts towards the timeout, so that a pool
+	// that is held up by a slow builtin still falls back in time.
+	start := time.Now()
+	wait, stop := afterTimeout(g.evalTimeout)
+	defer stop()
+	var vm *goja.Runtime
+	select {
+	case vm = <-pool:
+	case <-wait:
+		return g.timedOut(in)
+	}
+	timeout, ok := remainingTimeout(start, g.evalTimeout)
+	if !ok {
+		pool <- vm
+		return g.timedOut(in)
+	}
+
+	var proxies Proxies
+	err := runGoja(vm, timeout, func() error {
+		fn, err := gojaFindProxyFunc(vm)
+		if err != nil {
+			return err
+		}
+
+		value, err := fn(goja.Undefined(), vm.ToValue(in.String()), vm.ToValue(in.Hostname()))
+		if err != nil {
+			return err
+		}
+
+		proxies, err = ParseFindProxyString(value.String())
+		return err
+	}, func() {
+		// the VM only goes back once it is finished with, even if that is
+		// after the deadline
+		pool <- vm
+	})
+	if errors.Is(err, ErrTimeout) {
+		return g.timedOut(in)
+	}
+	if err != nil {
+		return Proxies{}, err
+	}
+	return proxies, nil
+}
+
+// gojaFindProxyFunc returns the PAC's FindProxyForURL function, preferring
+// Microsoft's IPv6 aware FindProxyForURLEx when the PAC defines it
+func gojaFindProxyFunc(vm *goja.Runtime) (goja.Callable, error) {
+	value := vm.Get("FindProxyForURLEx")
+	if _, ok := goja.AssertFunction(value); !ok {
+		value = vm.Get("FindProxyForURL")
+	}
+	// Report these the same way that otto does.
+	if value == nil || goja.IsUndefined(value) {
+		return nil, errors.New("ReferenceError: 'FindProxyForURL' is not defined")
+	}
+	fn, ok := goja.AssertFunction(value)
+	if !ok {
+		return nil, errors.New("TypeError: 'FindProxyForURL' is not a function")
+	}
+	return fn, nil
+}
+
+// timedOut returns the fallback for a FindProxyForURL call that took longer
+// than the eval timeout
+func (g *GojaEngine) timedOut(in *url.URL) (Proxies, error) {
+	return append(Proxies{}, g.fallback...), fmt.Errorf("%w: FindProxyForURL(%q) took longer than %s", ErrTimeout, in.String(), g.evalTimeout)
+}
@@ -0,0 +1,47 @@
+package pac
+
+import (
+	"testing"
+)
+
+func assertGoja(t *testing.T, pac string, u string, p []Proxy, e string) {
+	g := NewGojaEngine(
+		GojaStringLoader(pac),
+	)
+	if err := g.Start(); err != nil {
+		t.Errorf("failed to start goja: %q", err)
+		return
+	}
+	assertFind(t, g, u, p, e)
+	if err := g.Stop(); err != nil {
+		t.Errorf("failed to stop goja: %q", err)
+		return
+	}
+}
+
+func TestGojaWithModernJavascript(t *testing.T) {
+	pac := `
+const proxy = 'PROXY proxy.example.com:8080';
+let direct = ['.internal.example.com', '.local'];
+const FindProxyForURL = (url, host) => {
+	if (direct.some((d) => dnsDomainIs(host, d)) || host.includes('intranet')) {
+		return 'DIRECT';
+	}
+	return ` + "`${proxy}; DIRECT`" + `;
+};
+`
+	assertGoja(
+		t,
+		pac,
+		"http://www.example.com/page.html",
+		[]Proxy{Proxy{ProxyTypeHTTP, "proxy.example.com", 8080}, DirectProxy},
+		"",
+	)
+	assertGoja(
+		t,
+		pac,
+		"http://wiki.internal.example.com/page.html",
+		[]Proxy{DirectProxy},
+		"",
+	)
+}
@@ -0,0 +1,316 @@
+package pac
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPSourceOpt used to configure an HTTPSource via the NewHTTPSource func
+type HTTPSourceOpt func(*HTTPSource)
+
+// HTTPClient used to fetch the PAC, instead of http.DefaultClient
+func HTTPClient(c *http.Client) HTTPSourceOpt {
+	return func(s *HTTPSource) {
+		s.client = c
+	}
+}
+
+// HTTPHeader adds a header to every request for the PAC
+func HTTPHeader(name, value string) HTTPSourceOpt {
+	return func(s *HTTPSource) {
+		s.header.Add(name, value)
+	}
+}
+
+// HTTPBasicAuth authenticates requests for the PAC with a username and
+// password
+func HTTPBasicAuth(username, password string) HTTPSourceOpt {
+	return func(s *HTTPSource) {
+		auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		s.header.Set("Authorization", "Basic "+auth)
+	}
+}
+
+// HTTPBearerToken authenticates requests for the PAC with a bearer token
+func HTTPBearerToken(token string) HTTPSourceOpt {
+	return func(s *HTTPSource) {
+		s.header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// NewHTTPSource instance with configuration
+func NewHTTPSource(u *url.URL, opts ...HTTPSourceOpt) *HTTPSource {
+	s := &HTTPSource{
+		url:    u,
+		client: http.DefaultClient,
+		header: make(http.Header),
+		now:    time.Now,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// HTTPSource loads a PAC from a URL. It remembers the last response so that
+// later requests are conditional, and how long that response is fresh for.
+type HTTPSource struct {
+	mutex        sync.Mutex
+	url          *url.URL
+	client       *http.Client
+	header       http.Header
+	now          func() time.Time
+	pac          string
+	etag         string
+	lastModified string
+	fresh        time.Duration
+	hasFresh     bool
+	hasLoaded    bool
+	refreshed    bool
+}
+
+// URL that the PAC is loaded from
+func (s *HTTPSource) URL() *url.URL {
+	return s.url
+}
+
+// Load implements Loader. After a Refresh that found a change the next Load
+// uses what was fetched, rather than fetching the PAC again.
+func (s *HTTPSource) Load() (string, error) {
+	s.mutex.Lock()
+	if s.refreshed {
+		s.refreshed = false
+		pac := s.pac
+		s.mutex.Unlock()
+		return pac, nil
+	}
+	s.mutex.Unlock()
+	pac, _, err := s.fetch()
+	return pac, err
+}
+
+// Refresh fetches the PAC again, reporting whether its content changed
+func (s *HTTPSource) Refresh() (bool, error) {
+	_, changed, err := s.fetch()
+	s.mutex.Lock()
+	s.refreshed = changed
+	s.mutex.Unlock()
+	return changed, err
+}
+
+// Freshness of the last response, as given by its Cache-Control or Expires
+// header. ok is false when it had neither.
+func (s *HTTPSource) Freshness() (d time.Duration, ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.fresh, s.hasFresh
+}
+
+// loaded reports whether the PAC has ever been fetched
+func (s *HTTPSource) loaded() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.hasLoaded
+}
+
+func (s *HTTPSource) fetch() (string, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	log.Printf("loading pac from URL %q", s.url)
+	req, err := http.NewRequest(http.MethodGet, s.url.String(), nil)
+	if err != nil {
+		return "", false, err
+	}
+	for name, values := range s.header {
+		req.Header[name] = values
+	}
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	if s.lastModified != "" {
+		req.Header.Set("If-Modified-Since", s.lastModified)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if s.etag != "" || s.lastModified != "" {
+			log.Printf("pac at URL %q has not been modified", s.url)
+			s.fresh, s.hasFresh = freshness(res.Header, s.now())
+			return s.pac, false, nil
+		}
+		fallthrough
+	default:
+		return "", false, fmt.Errorf("unexpected status %q loading pac from URL %q", res.Status, s.url)
+	}
+	buf, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", false, err
+	}
+	pac := string(buf)
+	changed := !s.hasLoaded || pac != s.pac
+	s.hasLoaded = true
+	s.pac = pac
+	s.etag = res.Header.Get("ETag")
+	s.lastModified = res.Header.Get("Last-Modified")
+	s.fresh, s.hasFresh = freshness(res.Header, s.now())
+	return pac, changed, nil
+}
+
+// freshness lifetime of a response, from Cache-Control max-age or Expires
+func freshness(h http.Header, now time.Time) (time.Duration, bool) {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-cache" || directive == "no-store":
+			return 0, true
+		case strings.HasPrefix(directive, "max-age="):
+			seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err != nil {
+				continue
+			}
+			age, _ := strconv.Atoi(h.Get("Age"))
+			d := time.Duration(seconds-age) * time.Second
+			if d < 0 {
+				d = 0
+			}
+			return d, true
+		}
+	}
+	if expires := h.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			// invalid dates, such as "0", mean already expired
+			return 0, true
+		}
+		if date, err := http.ParseTime(h.Get("Date")); err == nil {
+			now = date
+		}
+		d := t.Sub(now)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// HTTPRefresherOpt used to configure an HTTPRefresher via the NewHTTPRefresher func
+type HTTPRefresherOpt func(*HTTPRefresher)
+
+// RefreshInterval sets how often the PAC is refreshed when the server does
+// not say how long it is fresh for. Failed refreshes are retried sooner,
+// backing off from the RefreshMinimum to this.
+func RefreshInterval(d time.Duration) HTTPRefresherOpt {
+	return func(r *HTTPRefresher) {
+		r.interval = d
+	}
+}
+
+// RefreshMinimum sets the shortest time between refreshes, however short a
+// time the server says the PAC is fresh for
+func RefreshMinimum(d time.Duration) HTTPRefresherOpt {
+	return func(r *HTTPRefresher) {
+		r.minimum = d
+	}
+}
+
+// NewHTTPRefresher instance with configuration
+func NewHTTPRefresher(source *HTTPSource, manager EngineManager, opts ...HTTPRefresherOpt) *HTTPRefresher {
+	r := &HTTPRefresher{
+		source:   source,
+		manager:  manager,
+		interval: time.Hour,
+		minimum:  time.Minute,
+		stop:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// HTTPRefresher periodically refreshes an HTTPSource and reloads an engine
+// whenever the content of the PAC changes.
+type HTTPRefresher struct {
+	source   *HTTPSource
+	manager  EngineManager
+	interval time.Duration
+	minimum  time.Duration
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Start refreshing
+func (r *HTTPRefresher) Start() {
+	go r.run()
+}
+
+// Stop refreshing
+func (r *HTTPRefresher) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+}
+
+func (r *HTTPRefresher) run() {
+	delay := r.delay()
+	retry := r.minimum
+	if !r.source.loaded() {
+		// loading failed when the engine was started
+		delay = r.minimum
+		retry = r.minimum * 2
+	}
+	for {
+		log.Printf("refreshing pac at URL %q in %s", r.source.URL(), delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-r.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		changed, err := r.source.Refresh()
+		if err != nil {
+			log.Printf("failed to refresh pac at URL %q: %s", r.source.URL(), err)
+			// retry sooner than usual, backing off to the usual interval
+			delay = retry
+			if retry *= 2; retry > r.interval {
+				retry = r.interval
+			}
+			continue
+		}
+		retry = r.minimum
+		if changed {
+			log.Printf("pac at URL %q changed, reloading", r.source.URL())
+			if err := r.manager.Reload(); err != nil {
+				log.Printf("failed to reload changed pac at URL %q: %s", r.source.URL(), err)
+			}
+		}
+		delay = r.delay()
+	}
+}
+
+// delay until the next refresh, honouring the freshness of the last response
+func (r *HTTPRefresher) delay() time.Duration {
+	d, ok := r.source.Freshness()
+	if !ok {
+		d = r.interval
+	}
+	if d < r.minimum {
+		d = r.minimum
+	}
+	return d
+}
@@ -0,0 +1,187 @@
+package pac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type pacServer struct {
+	mutex    sync.Mutex
+	pac      string
+	etag     string
+	header   http.Header
+	requests int
+	matched  int
+}
+
+func (s *pacServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests++
+	for k, v := range s.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("ETag", s.etag)
+	if r.Header.Get("If-None-Match") == s.etag {
+		s.matched++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write([]byte(s.pac))
+}
+
+func (s *pacServer) set(pac, etag string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pac = pac
+	s.etag = etag
+}
+
+func TestHTTPSourceConditionalRequests(t *testing.T) {
+	s := &pacServer{pac: DirectPAC, etag: `"1"`}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	u, _ := ParseHTTPURL(server.URL + "/proxy.pac")
+	source := NewHTTPSource(u)
+
+	pac, err := source.Load()
+	if err != nil || pac != DirectPAC {
+		t.Fatalf("unexpected load %q, %v", pac, err)
+	}
+	changed, err := source.Refresh()
+	if err != nil || changed {
+		t.Errorf("expecting no change, got %v, %v", changed, err)
+	}
+	if s.matched != 1 {
+		t.Errorf("expecting a conditional request")
+	}
+	pac, err = source.Load()
+	if err != nil || pac != DirectPAC {
+		t.Errorf("expecting the cached pac on a 304, got %q, %v", pac, err)
+	}
+
+	s.set("function FindProxyForURL(url, host){ return 'PROXY proxy.example.com:8080'; }", `"2"`)
+	changed, err = source.Refresh()
+	if err != nil || !changed {
+		t.Errorf("expecting a change, got %v, %v", changed, err)
+	}
+}
+
+func TestHTTPSourceLoadAfterRefresh(t *testing.T) {
+	s := &pacServer{pac: DirectPAC, etag: `"1"`}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	u, _ := ParseHTTPURL(server.URL + "/proxy.pac")
+	source := NewHTTPSource(u)
+	if _, err := source.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := source.Refresh(); err != nil || changed {
+		t.Errorf("expecting no change, got %v, %v", changed, err)
+	}
+	if _, err := source.Load(); err != nil || s.requests != 3 {
+		t.Errorf("expecting an unchanged refresh not to be reused, got %d requests, %v", s.requests, err)
+	}
+
+	changedPAC := "function FindProxyForURL(url, host){ return 'PROXY proxy.example.com:8080'; }"
+	s.set(changedPAC, `"2"`)
+	if changed, err := source.Refresh(); err != nil || !changed {
+		t.Errorf("expecting a change, got %v, %v", changed, err)
+	}
+	pac, err := source.Load()
+	if err != nil || pac != changedPAC {
+		t.Errorf("expecting the refreshed pac, got %q, %v", pac, err)
+	}
+	if s.requests != 4 {
+		t.Errorf("expecting the load after a refresh to use what was fetched, got %d requests", s.requests)
+	}
+	if _, err := source.Load(); err != nil || s.requests != 5 {
+		t.Errorf("expecting only the first load after a refresh to be reused, got %d requests, %v", s.requests, err)
+	}
+}
+
+func TestHTTPSourceStatus(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	u, _ := ParseHTTPURL(server.URL + "/proxy.pac")
+	if _, err := NewHTTPSource(u).Load(); err == nil {
+		t.Errorf("expecting an error for a 404")
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	now := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header http.Header
+		d      time.Duration
+		ok     bool
+	}{
+		{http.Header{}, 0, false},
+		{http.Header{"Cache-Control": {"public, max-age=600"}}, 10 * time.Minute, true},
+		{http.Header{"Cache-Control": {"max-age=600"}, "Age": {"60"}}, 9 * time.Minute, true},
+		{http.Header{"Cache-Control": {"no-cache"}, "Expires": {"Wed, 01 Jan 2020 01:00:00 GMT"}}, 0, true},
+		{http.Header{"Expires": {"Wed, 01 Jan 2020 01:00:00 GMT"}}, time.Hour, true},
+		{http.Header{"Expires": {"Wed, 01 Jan 2020 01:00:00 GMT"}, "Date": {"Wed, 01 Jan 2020 00:30:00 GMT"}}, 30 * time.Minute, true},
+		{http.Header{"Expires": {"0"}}, 0, true},
+	}
+	for _, test := range tests {
+		d, ok := freshness(test.header, now)
+		if d != test.d || ok != test.ok {
+			t.Errorf("expecting %s, %v for %v, got %s, %v", test.d, test.ok, test.header, d, ok)
+		}
+	}
+}
+
+func TestHTTPRefresher(t *testing.T) {
+	s := &pacServer{pac: DirectPAC, etag: `"1"`, header: http.Header{"Cache-Control": {"max-age=0"}}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	u, _ := ParseHTTPURL(server.URL + "/proxy.pac")
+	source := NewHTTPSource(u)
+	if _, err := source.Load(); err != nil {
+		t.Fatal(err)
+	}
+	m := &reloadNotifier{reloads: make(chan struct{}, 10)}
+	r := NewHTTPRefresher(source, m, RefreshMinimum(10*time.Millisecond))
+	r.Start()
+	defer r.Stop()
+
+	select {
+	case <-m.reloads:
+		t.Errorf("not expecting a reload when the pac is unchanged")
+	case <-time.After(100 * time.Millisecond):
+	}
+	s.set("function FindProxyForURL(url, host){ return 'PROXY proxy.example.com:8080'; }", `"2"`)
+	select {
+	case <-m.reloads:
+	case <-time.After(time.Second):
+		t.Errorf("expecting a reload when the pac changes")
+	}
+}
+
+func TestHTTPSourceAuthAndHeaders(t *testing.T) {
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		w.Write([]byte(DirectPAC))
+	}))
+	defer server.Close()
+	u, _ := ParseHTTPURL(server.URL + "/proxy.pac")
+
+	if _, err := NewHTTPSource(u, HTTPBearerToken("s3cret"), HTTPHeader("X-Device", "laptop")).Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got.Get("Authorization") != "Bearer s3cret" || got.Get("X-Device") != "laptop" {
+		t.Errorf("unexpected headers %v", got)
+	}
+
+	if _, err := NewHTTPSource(u, HTTPBasicAuth("user", "pass")).Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got.Get("Authorization") != "Basic dXNlcjpwYXNz" {
+		t.Errorf("unexpected headers %v", got)
+	}
+}
@@ -0,0 +1,107 @@
+package pac
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// NewLastGoodLoader instance that loads the PAC from file whenever loader
+// fails. PACs that loader loads are saved to file once they are passed to
+// Commit, so that one the engine rejects never replaces the last good one.
+func NewLastGoodLoader(loader Loader, file string) *LastGoodLoader {
+	return &LastGoodLoader{
+		loader: loader,
+		file:   file,
+	}
+}
+
+// LastGoodLoader keeps a last known good copy of a PAC on disk so that a PAC
+// is still available when its source is not, such as before a VPN is up.
+// While the copy is in use the loader is degraded.
+type LastGoodLoader struct {
+	mutex    sync.Mutex
+	loader   Loader
+	file     string
+	degraded error
+	loaded   string
+	pending  bool
+}
+
+// Load implements Loader
+func (l *LastGoodLoader) Load() (string, error) {
+	// The lock is not held while loading so that Status does not wait on a
+	// slow fetch.
+	pac, err := l.loader()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err == nil {
+		if l.degraded != nil {
+			log.Printf("PAC loaded again, no longer using the last known good PAC from %q", l.file)
+			l.degraded = nil
+		}
+		l.loaded, l.pending = pac, true
+		return pac, nil
+	}
+	info, statErr := os.Stat(l.file)
+	buf, readErr := ioutil.ReadFile(l.file)
+	if statErr != nil || readErr != nil {
+		return "", err
+	}
+	l.degraded = err
+	l.loaded, l.pending = "", false
+	log.Printf("DEGRADED: failed to load PAC, using the last known good PAC from %q saved at %s: %s", l.file, info.ModTime().Format(time.RFC3339), err)
+	return string(buf), nil
+}
+
+// Commit saves pac to the file as the last known good PAC, when it is what
+// the last Load got from the loader. Pass it to the engine's commit option so
+// that only PACs the engine accepts are saved.
+func (l *LastGoodLoader) Commit(pac string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.pending || pac != l.loaded {
+		return
+	}
+	l.pending = false
+	if err := l.save(pac); err != nil {
+		log.Printf("failed to save the last known good PAC to %q: %s", l.file, err)
+	}
+}
+
+// Degraded returns the error that caused the last known good PAC to be used
+// by the last Load, or nil if it was not used.
+func (l *LastGoodLoader) Degraded() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.degraded
+}
+
+// Status describes whether the last known good PAC is in use
+func (l *LastGoodLoader) Status() string {
+	if err := l.Degraded(); err != nil {
+		return fmt.Sprintf("degraded, using the last known good PAC from %q: %s", l.file, err)
+	}
+	return "ok"
+}
+
+// save pac to the file without ever leaving it partially written
+func (l *LastGoodLoader) save(pac string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(l.file), filepath.Base(l.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(pac); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.file)
+}
@@ -0,0 +1,134 @@
+package pac
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLastGoodLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paclastgood")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "last-good.pac")
+
+	pac, loadErr := DirectPAC, error(nil)
+	l := NewLastGoodLoader(func() (string, error) {
+		return pac, loadErr
+	}, file)
+
+	pac, loadErr = "", errors.New("unreachable")
+	if _, err := l.Load(); err == nil {
+		t.Errorf("expecting an error without a last known good PAC")
+	}
+
+	pac, loadErr = DirectPAC, nil
+	if got, err := l.Load(); err != nil || got != DirectPAC || l.Degraded() != nil {
+		t.Errorf("unexpected load %q, %v", got, err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("expecting the PAC not to be saved until it is committed, got %v", err)
+	}
+	l.Commit(DirectPAC)
+
+	pac, loadErr = "", errors.New("unreachable")
+	got, err := l.Load()
+	if err != nil || got != DirectPAC {
+		t.Errorf("expecting the last known good PAC, got %q, %v", got, err)
+	}
+	if l.Degraded() != loadErr {
+		t.Errorf("expecting to be degraded by %q, got %v", loadErr, l.Degraded())
+	}
+
+	pac, loadErr = "function FindProxyForURL(url, host){ return 'PROXY proxy.example.com:8080'; }", nil
+	if got, err := l.Load(); err != nil || got != pac || l.Degraded() != nil {
+		t.Errorf("expecting to recover, got %q, %v", got, err)
+	}
+	l.Commit(pac)
+	if buf, _ := ioutil.ReadFile(file); string(buf) != pac {
+		t.Errorf("expecting the last known good PAC to be replaced, got %q", buf)
+	}
+}
+
+func TestLastGoodLoaderOnlySavesWhatTheEngineAccepts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paclastgood")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "last-good.pac")
+
+	pac := DirectPAC
+	l := NewLastGoodLoader(func() (string, error) {
+		return pac, nil
+	}, file)
+	for _, engine := range testEngines {
+		os.Remove(file)
+		pac = DirectPAC
+		s := engineSettings{loader: l.Load, commit: l.Commit}
+		e := startEngine(t, engine.new, s)
+		if buf, _ := ioutil.ReadFile(file); string(buf) != DirectPAC {
+			t.Errorf("%s: expecting the started PAC to be saved, got %q", engine.name, buf)
+		}
+
+		pac = "function FindProxyForURL(url, host){ return 'DIRECT'"
+		if err := e.Reload(); err == nil {
+			t.Errorf("%s: expecting an error on reload", engine.name)
+		}
+		pac = "1 + 1"
+		if err := e.Reload(); err == nil {
+			t.Errorf("%s: expecting an error on reload", engine.name)
+		}
+		if buf, _ := ioutil.ReadFile(file); string(buf) != DirectPAC {
+			t.Errorf("%s: expecting a rejected PAC not to replace the last known good PAC, got %q", engine.name, buf)
+		}
+		// committing something other than what was loaded does nothing
+		l.Commit("function FindProxyForURL(url, host){ return 'PROXY other.example.com:8080'; }")
+		if buf, _ := ioutil.ReadFile(file); string(buf) != DirectPAC {
+			t.Errorf("%s: expecting a PAC that was not loaded not to be saved, got %q", engine.name, buf)
+		}
+
+		pac = "function FindProxyForURL(url, host){ return 'PROXY proxy.example.com:8080'; }"
+		if err := e.Reload(); err != nil {
+			t.Errorf("%s: unexpected error on reload: %q", engine.name, err)
+		}
+		if buf, _ := ioutil.ReadFile(file); string(buf) != pac {
+			t.Errorf("%s: expecting the reloaded PAC to be saved, got %q", engine.name, buf)
+		}
+		e.Stop()
+	}
+}
+
+func TestLastGoodLoaderStatusDuringLoad(t *testing.T) {
+	loading, release := make(chan struct{}), make(chan struct{})
+	l := NewLastGoodLoader(func() (string, error) {
+		close(loading)
+		<-release
+		return DirectPAC, nil
+	}, filepath.Join(os.TempDir(), "does-not-exist.pac"))
+	done := make(chan struct{})
+	go func() {
+		l.Load()
+		close(done)
+	}()
+	<-loading
+	status := make(chan string)
+	go func() {
+		status <- l.Status()
+	}()
+	select {
+	case s := <-status:
+		if s != "ok" {
+			t.Errorf("unexpected status %q", s)
+		}
+	case <-time.After(time.Second):
+		t.Error("expecting the status to not wait for the load")
+	}
+	close(release)
+	<-done
+}
@@ -4,32 +4,46 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"net/url"
 	"strings"
 )
 
-// SmartLoader attempt to detect if we are using js, a url, or a file path
-func SmartLoader(thing string) Loader {
+// SmartLoader attempt to detect if we are using js, a url, or a file path.
+// When given more than one thing each is tried in order, using the first
+// that loads and that otto can parse.
+func SmartLoader(things ...string) Loader {
+	sources := make([]Source, len(things))
+	for i, thing := range things {
+		sources[i] = NewSmartSource(thing)
+	}
+	return NewSourceList(ValidateOtto, sources...).Load
+}
+
+func smartLoader(thing string) Loader {
+	var source *HTTPSource
+	if u, ok := ParseHTTPURL(thing); ok {
+		source = NewHTTPSource(u)
+	}
 	return func() (string, error) {
 		if proxies, err := ParseFindProxyString(thing); err == nil {
 			log.Print("loading pac as a static string result")
 			return fmt.Sprintf("function FindProxyForURL(url, host){ return %q; }", proxies), nil
 		}
-		if strings.Contains(thing, "FindProxyForURL") && strings.Contains(thing, "{") {
+		if isJavascript(thing) {
 			log.Print("loading pac as string")
 			return thing, nil
 		}
-		if parseURL, parseErr := url.Parse(thing); parseErr == nil {
-			switch strings.ToLower(parseURL.Scheme) {
-			case "http", "https":
-				return HTTPLoader(parseURL)()
-			}
+		if source != nil {
+			return source.Load()
 		}
 		return FileLoader(thing)()
 	}
 }
 
+func isJavascript(thing string) bool {
+	return strings.Contains(thing, "FindProxyForURL") && strings.Contains(thing, "{")
+}
+
 func FileLoader(file string) Loader {
 	return func() (string, error) {
 		log.Printf("loading pac from file %q", file)
@@ -41,18 +55,19 @@ func FileLoader(file string) Loader {
 	}
 }
 
-func HTTPLoader(u *url.URL) Loader {
-	return func() (string, error) {
-		log.Printf("loading pac from URL %q", u)
-		res, err := http.Get(u.String())
-		if err != nil {
-			return "", err
-		}
-		defer res.Body.Close()
-		pac, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			return "", err
-		}
-		return string(pac), nil
+// ParseHTTPURL returns thing as a URL if it is an http or https one
+func ParseHTTPURL(thing string) (*url.URL, bool) {
+	u, err := url.Parse(thing)
+	if err != nil {
+		return nil, false
 	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return u, true
+	}
+	return nil, false
+}
+
+func HTTPLoader(u *url.URL) Loader {
+	return NewHTTPSource(u).Load
 }
@@ -2,9 +2,12 @@ package pac
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"net/url"
+	"runtime"
 	"sync"
+	"time"
 
 	"github.com/robertkrimen/otto"
 	"github.com/williambailey/pacproxy/pacfunc"
@@ -20,6 +23,71 @@ func OttoLoader(fn Loader) OttoEngineOpt {
 	}
 }
 
+// OttoPoolSize sets how many VMs are loaded with the PAC so that lookups
+// can be evaluated in parallel
+func OttoPoolSize(n int) OttoEngineOpt {
+	return func(o *OttoEngine) {
+		o.poolSize = n
+	}
+}
+
+// OttoEvalTimeout sets how long each FindProxyForURL call may take before it
+// is interrupted
+func OttoEvalTimeout(d time.Duration) OttoEngineOpt {
+	return func(o *OttoEngine) {
+		o.evalTimeout = d
+	}
+}
+
+// OttoStartTimeout sets how long running the PAC, when the engine is started
+// or reloaded, may take before it is interrupted
+func OttoStartTimeout(d time.Duration) OttoEngineOpt {
+	return func(o *OttoEngine) {
+		o.startTimeout = d
+	}
+}
+
+// OttoFallback sets the result that FindProxyForURL returns, along with the
+// error, when it is interrupted
+func OttoFallback(p Proxies) OttoEngineOpt {
+	return func(o *OttoEngine) {
+		o.fallback = p
+	}
+}
+
+// OttoResolver sets the resolver that the PAC DNS functions use. When it is a
+// pacfunc.DNSCache it is purged whenever the engine is reloaded.
+func OttoResolver(r pacfunc.Resolver) OttoEngineOpt {
+	return func(o *OttoEngine) {
+		o.dns = pacfunc.DNS{Resolver: r}
+	}
+}
+
+// OttoNower sets what the PAC date and time functions use to get the
+// current time
+func OttoNower(n pacfunc.Nower) OttoEngineOpt {
+	return func(o *OttoEngine) {
+		o.clock.Nower = n
+	}
+}
+
+// OttoLocation sets the time zone that the PAC date and time functions use
+// when they are not asked for GMT, instead of the local one
+func OttoLocation(loc *time.Location) OttoEngineOpt {
+	return func(o *OttoEngine) {
+		o.clock.Location = loc
+	}
+}
+
+// OttoCommit sets a func that is called with the PAC each time the engine is
+// started or reloaded with it, once it is in use. fn must not use the
+// engine.
+func OttoCommit(fn func(pac string)) OttoEngineOpt {
+	return func(o *OttoEngine) {
+		o.commit = fn
+	}
+}
+
 // OttoStringLoader implements a string loader
 func OttoStringLoader(pac string) OttoEngineOpt {
 	return OttoLoader(func() (string, error) {
@@ -34,19 +102,30 @@ func NewOttoEngine(opts ...OttoEngineOpt) *OttoEngine {
 		loader: func() (string, error) {
 			return "", errors.New("pac loader has not been configured")
 		},
+		poolSize: runtime.NumCPU(),
 	}
 	for _, opt := range opts {
 		opt(otto)
 	}
+	if otto.poolSize < 1 {
+		otto.poolSize = 1
+	}
 	return otto
 }
 
 // OttoEngine struct
 type OttoEngine struct {
-	mutex     *sync.RWMutex
-	loader    Loader
-	isStarted bool
-	vm        *otto.Otto
+	mutex        *sync.RWMutex
+	loader       Loader
+	poolSize     int
+	evalTimeout  time.Duration
+	startTimeout time.Duration
+	fallback     Proxies
+	dns          pacfunc.DNS
+	clock        pacfunc.Clock
+	commit       func(pac string)
+	isStarted    bool
+	pool         chan *otto.Otto
 }
 
 func (o *OttoEngine) Start() error {
@@ -71,6 +150,43 @@ func (o *OttoEngine) Start() error {
 		return nil
 	}
 	log.Print("initialising OttoEngine")
+	pool, pac, err := o.newPool()
+	if err != nil {
+		return err
+	}
+	o.pool = pool
+	o.isStarted = true
+	if o.commit != nil {
+		o.commit(pac)
+	}
+
+	return nil
+}
+
+// newPool loads the PAC once and runs it in each of a new set of VMs, failing
+// if the PAC does not define FindProxyForURL as a function
+func (o *OttoEngine) newPool() (chan *otto.Otto, string, error) {
+	pac, err := o.loader()
+	if err != nil {
+		return nil, "", err
+	}
+	log.Print("PAC:\n" + pac + "\n")
+	pool := make(chan *otto.Otto, o.poolSize)
+	for i := 0; i < o.poolSize; i++ {
+		vm, err := newOttoVM(pac, o.startTimeout, o.dns, o.clock)
+		if err != nil {
+			return nil, "", err
+		}
+		// A PAC that runs but can't be used must not replace one that can.
+		if err := ottoCheckFindProxyFunc(vm); err != nil {
+			return nil, "", err
+		}
+		pool <- vm
+	}
+	return pool, pac, nil
+}
+
+func newOttoVM(pac string, timeout time.Duration, dns pacfunc.DNS, clock pacfunc.Clock) (*otto.Otto, error) {
 	vm := otto.New()
 
 	// ConvertAddr(ipaddr string)
@@ -147,7 +263,7 @@ func (o *OttoEngine) Start() error {
 		if netmask, err = call.Argument(2).ToString(); err != nil {
 			return
 		}
-		if v, err := vm.ToValue(pacfunc.IsInNet(host, netip, netmask)); err == nil {
+		if v, err := vm.ToValue(dns.IsInNet(host, netip, netmask)); err == nil {
 			value = v
 		}
 		return
@@ -156,7 +272,7 @@ func (o *OttoEngine) Start() error {
 	// MyIPAddress() string
 	vm.Set("myIpAddress", func(call otto.FunctionCall) (value otto.Value) {
 		value = otto.NullValue()
-		if v, err := vm.ToValue(pacfunc.MyIPAddress()); err == nil {
+		if v, err := vm.ToValue(dns.MyIPAddress()); err == nil {
 			value = v
 		}
 		return
@@ -172,7 +288,7 @@ func (o *OttoEngine) Start() error {
 		if host, err = call.Argument(0).ToString(); err != nil {
 			return
 		}
-		if v, err := vm.ToValue(pacfunc.DNSResolve(host)); err == nil {
+		if v, err := vm.ToValue(dns.DNSResolve(host)); err == nil {
 			value = v
 		}
 		return
@@ -224,7 +340,7 @@ func (o *OttoEngine) Start() error {
 		if host, err = call.Argument(0).ToString(); err != nil {
 			return
 		}
-		if v, err := vm.ToValue(pacfunc.IsResolvable(host)); err == nil {
+		if v, err := vm.ToValue(dns.IsResolvable(host)); err == nil {
 			value = v
 		}
 		return
@@ -267,7 +383,7 @@ func (o *OttoEngine) Start() error {
 		} else {
 			gmt = ""
 		}
-		if v, err := vm.ToValue(pacfunc.WeekdayRange(wd1, wd2, gmt)); err == nil {
+		if v, err := vm.ToValue(clock.WeekdayRange(wd1, wd2, gmt)); err == nil {
 			value = v
 		}
 		return
@@ -280,7 +396,7 @@ func (o *OttoEngine) Start() error {
 		for i := 0; i < len(call.ArgumentList); i++ {
 			args[i], _ = call.ArgumentList[i].ToString()
 		}
-		if v, err := vm.ToValue(pacfunc.DateRange(args)); err == nil {
+		if v, err := vm.ToValue(clock.DateRange(args)); err == nil {
 			value = v
 		}
 		return
@@ -293,30 +409,191 @@ func (o *OttoEngine) Start() error {
 		for i := 0; i < len(call.ArgumentList); i++ {
 			args[i], _ = call.ArgumentList[i].ToString()
 		}
-		if v, err := vm.ToValue(pacfunc.TimeRange(args)); err == nil {
+		if v, err := vm.ToValue(clock.TimeRange(args)); err == nil {
+			value = v
+		}
+		return
+	})
+
+	// IsInNetEx(ipaddr, ipprefix string) bool
+	vm.Set("isInNetEx", func(call otto.FunctionCall) (value otto.Value) {
+		value = otto.FalseValue()
+		var (
+			ipaddr   string
+			ipprefix string
+			err      error
+		)
+		if ipaddr, err = call.Argument(0).ToString(); err != nil {
+			return
+		}
+		if ipprefix, err = call.Argument(1).ToString(); err != nil {
+			return
+		}
+		if v, err := vm.ToValue(pacfunc.IsInNetEx(ipaddr, ipprefix)); err == nil {
+			value = v
+		}
+		return
+	})
+
+	// MyIPAddressEx() string
+	vm.Set("myIpAddressEx", func(call otto.FunctionCall) (value otto.Value) {
+		value = otto.NullValue()
+		if v, err := vm.ToValue(dns.MyIPAddressEx()); err == nil {
+			value = v
+		}
+		return
+	})
+
+	// DNSResolveEx(host string) string
+	vm.Set("dnsResolveEx", func(call otto.FunctionCall) (value otto.Value) {
+		value = otto.FalseValue()
+		var (
+			host string
+			err  error
+		)
+		if host, err = call.Argument(0).ToString(); err != nil {
+			return
+		}
+		if v, err := vm.ToValue(dns.DNSResolveEx(host)); err == nil {
 			value = v
 		}
 		return
 	})
 
-	{
-		pac, pacError := o.loader()
-		if pacError != nil {
-			return pacError
+	// IsResolvableEx(host string) bool
+	vm.Set("isResolvableEx", func(call otto.FunctionCall) (value otto.Value) {
+		value = otto.FalseValue()
+		var (
+			host string
+			err  error
+		)
+		if host, err = call.Argument(0).ToString(); err != nil {
+			return
+		}
+		if v, err := vm.ToValue(dns.IsResolvableEx(host)); err == nil {
+			value = v
+		}
+		return
+	})
+
+	// SortIPAddressList(list string) (string, bool)
+	vm.Set("sortIpAddressList", func(call otto.FunctionCall) (value otto.Value) {
+		value = otto.FalseValue()
+		var (
+			list string
+			err  error
+		)
+		if list, err = call.Argument(0).ToString(); err != nil {
+			return
+		}
+		sorted, ok := pacfunc.SortIPAddressList(list)
+		if !ok {
+			return
 		}
-		log.Print("PAC:\n" + pac + "\n")
-		_, pacError = vm.Run(pac)
-		if pacError != nil {
-			return pacError
+		if v, err := vm.ToValue(sorted); err == nil {
+			value = v
+		}
+		return
+	})
+
+	// GetClientVersion() string
+	vm.Set("getClientVersion", func(call otto.FunctionCall) (value otto.Value) {
+		value = otto.NullValue()
+		if v, err := vm.ToValue(pacfunc.GetClientVersion()); err == nil {
+			value = v
 		}
+		return
+	})
+
+	err := runOtto(vm, timeout, func() error {
+		_, err := vm.Run(pac)
+		return err
+	}, nil)
+	if errors.Is(err, ErrTimeout) {
+		return nil, fmt.Errorf("%w: running the PAC took longer than %s", ErrTimeout, timeout)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	o.vm = vm
-	o.isStarted = true
+	return vm, nil
+}
 
+// ottoCheckFindProxyFunc returns the error that calling FindProxyForURL would
+// give when the PAC does not define it as a function
+func ottoCheckFindProxyFunc(vm *otto.Otto) error {
+	value, err := vm.Get(ottoFindProxyFunc(vm))
+	if err != nil {
+		return err
+	}
+	if value.IsUndefined() {
+		return errors.New("ReferenceError: 'FindProxyForURL' is not defined")
+	}
+	if !value.IsFunction() {
+		return errors.New("TypeError: 'FindProxyForURL' is not a function")
+	}
 	return nil
 }
 
+// ottoFindProxyFunc returns the name of the function to call, preferring
+// Microsoft's IPv6 aware FindProxyForURLEx when the PAC defines it
+func ottoFindProxyFunc(vm *otto.Otto) string {
+	if value, err := vm.Get("FindProxyForURLEx"); err == nil && value.IsFunction() {
+		return "FindProxyForURLEx"
+	}
+	return "FindProxyForURL"
+}
+
+// ValidateOtto implements Validator using an OttoEngine with the default
+// configuration
+func ValidateOtto(name, pac string) error {
+	return NewOttoEngine().Validate(name, pac)
+}
+
+// Validate implements Validator, checking that pac runs in a VM configured
+// as the engine's are and that it defines FindProxyForURL
+func (o *OttoEngine) Validate(name, pac string) error {
+	if _, err := otto.New().Compile(name, pac); err != nil {
+		return err
+	}
+	vm, err := newOttoVM(pac, o.startTimeout, o.dns, o.clock)
+	if err != nil {
+		return err
+	}
+	return ottoCheckFindProxyFunc(vm)
+}
+
+// errOttoInterrupted is what an interrupted otto VM panics with
+var errOttoInterrupted = errors.New("interrupted")
+
+// runOtto calls fn, which should use vm, interrupting vm and returning
+// ErrTimeout if it takes longer than timeout. release, when not nil, is
+// called once vm is finished with and can no longer be interrupted.
+func runOtto(vm *otto.Otto, timeout time.Duration, fn func() error, release func()) error {
+	interrupt := make(chan func(), 1)
+	vm.Interrupt = interrupt
+	return withDeadline(
+		timeout,
+		func() {
+			interrupt <- func() {
+				panic(errOttoInterrupted)
+			}
+		},
+		func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					if r != errOttoInterrupted {
+						panic(r)
+					}
+					err = ErrTimeout
+				}
+			}()
+			return fn()
+		},
+		release,
+	)
+}
+
 func (o *OttoEngine) Stop() error {
 	defer func() {
 		o.mutex.RLock()
@@ -339,34 +616,94 @@ func (o *OttoEngine) Stop() error {
 		return nil
 	}
 	log.Print("stopping OttoEngine")
-	o.vm = nil
+	o.pool = nil
 	o.isStarted = false
 	return nil
 }
 
+// Reload loads a new pool of VMs and then swaps it for the current one, so
+// lookups are never evaluated against a partially loaded pool. If the new
+// PAC fails to load the current one is kept, along with any cached DNS
+// lookups; otherwise they are purged once the new pool is in use.
 func (o *OttoEngine) Reload() error {
-	if err := o.Stop(); err != nil {
-		return err
+	o.mutex.RLock()
+	isStarted := o.isStarted
+	o.mutex.RUnlock()
+	if !isStarted {
+		return o.Start()
 	}
-	if err := o.Start(); err != nil {
+	log.Print("reloading OttoEngine")
+	pool, pac, err := o.newPool()
+	if err != nil {
+		log.Print("failed to reload OttoEngine, keeping the current PAC")
 		return err
 	}
+	o.mutex.Lock()
+	o.pool = pool
+	o.mutex.Unlock()
+	purgeDNSCache(o.dns)
+	if o.commit != nil {
+		o.commit(pac)
+	}
+	log.Print("reloaded OttoEngine")
 	return nil
 }
 
 func (o *OttoEngine) FindProxyForURL(in *url.URL) (Proxies, error) {
-	o.mutex.Lock()
-	defer o.mutex.Unlock()
+	o.mutex.RLock()
+	pool := o.pool
+	o.mutex.RUnlock()
+	if pool == nil {
+		return Proxies{}, errors.New("OttoEngine has not been started")
+	}
 
-	value, err := o.vm.Call("FindProxyForURL", nil, in.String(), in.Hostname())
-	if err != nil {
-		return Proxies{}, err
+	// Waiting for a free VM counts towards the timeout, so that a pool
+	// that is held up by a slow builtin still falls back in time.
+	start := time.Now()
+	wait, stop := afterTimeout(o.evalTimeout)
+	defer stop()
+	var vm *otto.Otto
+	select {
+	case vm = <-pool:
+	case <-wait:
+		return o.timedOut(in)
 	}
+	timeout, ok := remainingTimeout(start, o.evalTimeout)
+	if !ok {
+		pool <- vm
+		return o.timedOut(in)
+	}
+
+	var proxies Proxies
+	err := runOtto(vm, timeout, func() error {
+		value, err := vm.Call(ottoFindProxyFunc(vm), nil, in.String(), in.Hostname())
+		if err != nil {
+			return err
+		}
+
+		findProxyString, err := otto.Value.ToString(value)
+		if err != nil {
+			return err
+		}
 
-	findProxyString, err := otto.Value.ToString(value)
+		proxies, err = ParseFindProxyString(findProxyString)
+		return err
+	}, func() {
+		// the VM only goes back once it is finished with, even if that is
+		// after the deadline
+		pool <- vm
+	})
+	if errors.Is(err, ErrTimeout) {
+		return o.timedOut(in)
+	}
 	if err != nil {
 		return Proxies{}, err
 	}
+	return proxies, nil
+}
 
-	return ParseFindProxyString(findProxyString)
+// timedOut returns the fallback for a FindProxyForURL call that took longer
+// than the eval timeout
+func (o *OttoEngine) timedOut(in *url.URL) (Proxies, error) {
+	return append(Proxies{}, o.fallback...), fmt.Errorf("%w: FindProxyForURL(%q) took longer than %s", ErrTimeout, in.String(), o.evalTimeout)
 }
@@ -13,14 +13,14 @@ func assertOtto(t *testing.T, pac string, u string, p []Proxy, e string) {
 		t.Errorf("failed to start otto: %q", err)
 		return
 	}
-	assertOttoFind(t, o, u, p, e)
+	assertFind(t, o, u, p, e)
 	if err := o.Stop(); err != nil {
 		t.Errorf("failed to stop otto: %q", err)
 		return
 	}
 }
 
-func assertOttoFind(t *testing.T, o *OttoEngine, u string, p []Proxy, e string) {
+func assertFind(t *testing.T, o ProxyFinder, u string, p []Proxy, e string) {
 	url, err := url.Parse(u)
 	if err != nil {
 		t.Errorf("failed to parse url: %q", err)
@@ -84,23 +84,25 @@ func TestOttoFindProxyForURL(t *testing.T) {
 }
 
 func TestOttoWithUndefinedFindProxyForURLFunction(t *testing.T) {
-	assertOtto(
-		t,
-		"1 + 1",
-		"http://www.example.com/page.html",
-		[]Proxy{},
-		"ReferenceError: 'FindProxyForURL' is not defined",
+	o := NewOttoEngine(
+		OttoStringLoader("1 + 1"),
 	)
+	err := o.Start()
+	e := "ReferenceError: 'FindProxyForURL' is not defined"
+	if err == nil || err.Error() != e {
+		t.Errorf("expecting error %q on start, got %v", e, err)
+	}
 }
 
 func TestOttoWithNonFindProxyForURLFunction(t *testing.T) {
-	assertOtto(
-		t,
-		"FindProxyForURL = 1234",
-		"http://www.example.com/page.html",
-		[]Proxy{},
-		"TypeError: 'FindProxyForURL' is not a function",
+	o := NewOttoEngine(
+		OttoStringLoader("FindProxyForURL = 1234"),
 	)
+	err := o.Start()
+	e := "TypeError: 'FindProxyForURL' is not a function"
+	if err == nil || err.Error() != e {
+		t.Errorf("expecting error %q on start, got %v", e, err)
+	}
 }
 
 func TestOttoWithFindProxyForURLFunctionThatReturnsInvalidValue(t *testing.T) {
@@ -128,7 +130,7 @@ func TestOttoWithFindProxyForURLFunctionThatReturnsMultipleValues(t *testing.T)
 		t,
 		"function FindProxyForURL(url, host){ return 'PROXY proxy.example.com:8080; DIRECT'; }",
 		"http://www.example.com/page.html",
-		[]Proxy{Proxy{"proxy.example.com", 8080}, DirectProxy},
+		[]Proxy{Proxy{ProxyTypeHTTP, "proxy.example.com", 8080}, DirectProxy},
 		"",
 	)
 }
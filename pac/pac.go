@@ -3,7 +3,10 @@ package pac
 import (
 	"bytes"
 	"fmt"
+	"net"
 	"net/url"
+	"strconv"
+	"time"
 )
 
 // DirectPAC for simply always returning "DIRECT"
@@ -16,6 +19,12 @@ type EngineManager interface {
 	Reload() error
 }
 
+// Engine is a managed runtime that is able to find proxies from a PAC
+type Engine interface {
+	EngineManager
+	ProxyFinder
+}
+
 // Proxies is a slice of Proxy that implements Stringer
 type Proxies []Proxy
 
@@ -30,6 +39,17 @@ func (p Proxies) String() string {
 	return b.String()
 }
 
+// Without returns a copy of p with every occurrence of proxy removed
+func (p Proxies) Without(proxy Proxy) Proxies {
+	without := make(Proxies, 0, len(p))
+	for _, v := range p {
+		if v != proxy {
+			without = append(without, v)
+		}
+	}
+	return without
+}
+
 // Loader to load the pac as a string
 type Loader func() (string, error)
 
@@ -43,29 +63,62 @@ type ProxySelector interface {
 	SelectProxy(from Proxies) Proxy
 }
 
-/* TODO: Look again at handling multiple proxy entries better...
+// ProxyOrderer is implemented by selectors that can put all of the proxies
+// for a URL into the order that they should be tried in
+type ProxyOrderer interface {
+	OrderProxies(in *url.URL, from Proxies) Proxies
+}
+
+// LatencyRecorder is told how long it took to connect to a proxy
+type LatencyRecorder interface {
+	RecordLatency(p Proxy, d time.Duration)
+}
+
 // ProxyChecker is used when trying to decide which proxy one might use
 type ProxyChecker interface {
 	IsHealthy(p Proxy) bool
 	RecordSuccess(p Proxy)
-	RecordFailure(p Proxy)
+	RecordFailure(p Proxy, reason error)
 	ResetRecord(p Proxy)
 	ResetAll()
 }
-*/
+
+// ProxyType is the PAC directive used to describe a Proxy
+type ProxyType string
+
+// Supported proxy types
+const (
+	ProxyTypeDirect ProxyType = "DIRECT"
+	ProxyTypeHTTP   ProxyType = "PROXY"
+	ProxyTypeHTTPS  ProxyType = "HTTPS"
+	ProxyTypeSOCKS  ProxyType = "SOCKS"
+	ProxyTypeSOCKS4 ProxyType = "SOCKS4"
+	ProxyTypeSOCKS5 ProxyType = "SOCKS5"
+)
+
+// IsSOCKS returns true for any of the SOCKS proxy types
+func (t ProxyType) IsSOCKS() bool {
+	return t == ProxyTypeSOCKS || t == ProxyTypeSOCKS4 || t == ProxyTypeSOCKS5
+}
 
 // Proxy information struct
 type Proxy struct {
+	Type     ProxyType
 	Hostname string
 	Port     int
 }
 
+// Address of the proxy in "host:port" form
+func (p Proxy) Address() string {
+	return net.JoinHostPort(p.Hostname, strconv.Itoa(p.Port))
+}
+
 func (p Proxy) String() string {
 	if p == DirectProxy {
 		return "DIRECT"
 	}
-	return fmt.Sprintf("PROXY %s:%d", p.Hostname, p.Port)
+	return fmt.Sprintf("%s %s", p.Type, p.Address())
 }
 
 // DirectProxy is used to represent a "DIRECT" value
-var DirectProxy = Proxy{}
+var DirectProxy = Proxy{Type: ProxyTypeDirect}
@@ -0,0 +1,18 @@
+package pac
+
+import "testing"
+
+func TestProxiesWithout(t *testing.T) {
+	a := Proxy{ProxyTypeHTTP, "a.example.com", 8080}
+	b := Proxy{ProxyTypeSOCKS5, "b.example.com", 1080}
+	proxies := Proxies{a, DirectProxy, b, a}
+	if s := proxies.Without(a).String(); s != "DIRECT; SOCKS5 b.example.com:1080" {
+		t.Errorf("unexpected result removing %q, got %q", a, s)
+	}
+	if s := proxies.Without(DirectProxy).String(); s != "PROXY a.example.com:8080; SOCKS5 b.example.com:1080; PROXY a.example.com:8080" {
+		t.Errorf("unexpected result removing %q, got %q", DirectProxy, s)
+	}
+	if s := proxies.String(); s != "PROXY a.example.com:8080; DIRECT; SOCKS5 b.example.com:1080; PROXY a.example.com:8080" {
+		t.Errorf("expected the original to be left alone, got %q", s)
+	}
+}
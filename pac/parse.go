@@ -20,7 +20,7 @@ func init() {
 
 // ParseFindProxyString into a Proxies
 func ParseFindProxyString(s string) (Proxies, error) {
-	// "PROXY proxy.example.com:8080; DIRECT"
+	// "HTTPS secure.example.com:443; PROXY proxy.example.com:8080; SOCKS5 socks.example.com:1080; DIRECT"
 	var (
 		proxies  Proxies
 		url      *url.URL
@@ -35,10 +35,11 @@ func ParseFindProxyString(s string) (Proxies, error) {
 			continue
 		}
 		part := pacItemSplit.Split(statement, 2)
-		switch strings.ToUpper(part[0]) {
-		case "DIRECT":
+		proxyType := ProxyType(strings.ToUpper(part[0]))
+		switch proxyType {
+		case ProxyTypeDirect:
 			proxies = append(proxies, DirectProxy)
-		case "PROXY":
+		case ProxyTypeHTTP, ProxyTypeHTTPS, ProxyTypeSOCKS, ProxyTypeSOCKS4, ProxyTypeSOCKS5:
 			if len(part) != 2 {
 				return Proxies{}, fmt.Errorf("unable to parse proxy details from %q", statement)
 			}
@@ -56,6 +57,7 @@ func ParseFindProxyString(s string) (Proxies, error) {
 				return Proxies{}, portErr
 			}
 			proxies = append(proxies, Proxy{
+				Type:     proxyType,
 				Hostname: url.Hostname(),
 				Port:     portInt,
 			})
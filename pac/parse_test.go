@@ -12,11 +12,18 @@ var parsetests = []struct {
 	err     error
 }{
 	{"DIRECT", []Proxy{DirectProxy}, nil},
-	{"PROXY proxy.example.com:8080", []Proxy{Proxy{"proxy.example.com", 8080}}, nil},
-	{"PROXY proxy.example.com:8080;", []Proxy{Proxy{"proxy.example.com", 8080}}, nil},
-	{"PROXY proxy.example.com:8080;  ; ;;", []Proxy{Proxy{"proxy.example.com", 8080}}, nil},
-	{"PROXY proxy.example.com:8080; DIRECT", []Proxy{Proxy{"proxy.example.com", 8080}, DirectProxy}, nil},
-	{"PROXY proxy.example.com:8080; DIRECT; PROXY proxy.example.org:8888", []Proxy{Proxy{"proxy.example.com", 8080}, DirectProxy, Proxy{"proxy.example.org", 8888}}, nil},
+	{"PROXY proxy.example.com:8080", []Proxy{Proxy{ProxyTypeHTTP, "proxy.example.com", 8080}}, nil},
+	{"PROXY proxy.example.com:8080;", []Proxy{Proxy{ProxyTypeHTTP, "proxy.example.com", 8080}}, nil},
+	{"PROXY proxy.example.com:8080;  ; ;;", []Proxy{Proxy{ProxyTypeHTTP, "proxy.example.com", 8080}}, nil},
+	{"PROXY proxy.example.com:8080; DIRECT", []Proxy{Proxy{ProxyTypeHTTP, "proxy.example.com", 8080}, DirectProxy}, nil},
+	{"PROXY proxy.example.com:8080; DIRECT; PROXY proxy.example.org:8888", []Proxy{Proxy{ProxyTypeHTTP, "proxy.example.com", 8080}, DirectProxy, Proxy{ProxyTypeHTTP, "proxy.example.org", 8888}}, nil},
+	{"SOCKS socks.example.com:1080", []Proxy{Proxy{ProxyTypeSOCKS, "socks.example.com", 1080}}, nil},
+	{"socks4 socks.example.com:1080", []Proxy{Proxy{ProxyTypeSOCKS4, "socks.example.com", 1080}}, nil},
+	{"SOCKS5 gw.corp:1080; PROXY web.corp:3128", []Proxy{Proxy{ProxyTypeSOCKS5, "gw.corp", 1080}, Proxy{ProxyTypeHTTP, "web.corp", 3128}}, nil},
+	{"SOCKS5 [::1]:1080", []Proxy{Proxy{ProxyTypeSOCKS5, "::1", 1080}}, nil},
+	{"HTTPS secure-proxy.corp:443", []Proxy{Proxy{ProxyTypeHTTPS, "secure-proxy.corp", 443}}, nil},
+	{"HTTPS", []Proxy{}, errors.New("unable to parse proxy details from \"HTTPS\"")},
+	{"SOCKS5", []Proxy{}, errors.New("unable to parse proxy details from \"SOCKS5\"")},
 	{"FOO", []Proxy{}, errors.New("unsupported PAC command \"FOO\"")},
 	{"PROXY", []Proxy{}, errors.New("unable to parse proxy details from \"PROXY\"")},
 	{"PROXY http://foo.bar:8080", []Proxy{}, errors.New("unable to parse hostname and port from \"http://foo.bar:8080\"")},
@@ -40,3 +47,26 @@ func TestParseFindProxyString(t *testing.T) {
 		}
 	}
 }
+
+var roundtriptests = []string{
+	"DIRECT",
+	"PROXY proxy.example.com:8080",
+	"SOCKS socks.example.com:1080",
+	"SOCKS4 socks.example.com:1080",
+	"SOCKS5 socks.example.com:1080; PROXY proxy.example.com:8080; DIRECT",
+	"SOCKS5 [::1]:1080",
+	"HTTPS secure-proxy.corp:443; DIRECT",
+}
+
+func TestProxiesStringRoundTrip(t *testing.T) {
+	for _, in := range roundtriptests {
+		proxies, err := ParseFindProxyString(in)
+		if err != nil {
+			t.Errorf("%q unexpected error %q", in, err)
+			continue
+		}
+		if out := proxies.String(); out != in {
+			t.Errorf("%q expected to round trip, got %q", in, out)
+		}
+	}
+}
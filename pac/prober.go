@@ -0,0 +1,193 @@
+package pac
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ProbeFunc checks that p is working. When canary is set it should also
+// check that p is able to connect to it.
+type ProbeFunc func(ctx context.Context, p Proxy, canary string) error
+
+// ProbeConfig for probing a proxy
+type ProbeConfig struct {
+	// Interval between probes, zero disables probing
+	Interval time.Duration
+	// Timeout for each probe
+	Timeout time.Duration
+	// Canary "host:port" to connect to through the proxy, if any
+	Canary string
+}
+
+// ProxyProberOpt used to configure a ProxyProber via the NewProxyProber func
+type ProxyProberOpt func(*ProxyProber)
+
+// ProbeDefaults used for any proxy without its own ProbeConfig
+func ProbeDefaults(cfg ProbeConfig) ProxyProberOpt {
+	return func(p *ProxyProber) {
+		p.defaults = cfg
+	}
+}
+
+// ProbeProxy overrides the ProbeConfig for any proxy with the given
+// "host:port" address.
+func ProbeProxy(address string, cfg ProbeConfig) ProxyProberOpt {
+	return func(p *ProxyProber) {
+		p.configs[address] = cfg
+	}
+}
+
+// ProbeExpiry sets how long a proxy continues to be probed for after it was
+// last seen in a PAC result.
+func ProbeExpiry(d time.Duration) ProxyProberOpt {
+	return func(p *ProxyProber) {
+		p.expiry = d
+	}
+}
+
+// NewProxyProber instance with configuration
+func NewProxyProber(checker ProxyChecker, probe ProbeFunc, opts ...ProxyProberOpt) *ProxyProber {
+	p := &ProxyProber{
+		checker: checker,
+		probe:   probe,
+		defaults: ProbeConfig{
+			Interval: 30 * time.Second,
+			Timeout:  5 * time.Second,
+		},
+		configs: make(map[string]ProbeConfig),
+		expiry:  30 * time.Minute,
+		now:     time.Now,
+		targets: make(map[Proxy]*probeTarget),
+		stop:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// ProxyProber periodically probes every proxy that it is told about via
+// Observe and records the outcome with a ProxyChecker, so that a proxy that
+// has gone away is skipped before a request has to wait for it to time out.
+type ProxyProber struct {
+	mutex    sync.Mutex
+	checker  ProxyChecker
+	probe    ProbeFunc
+	defaults ProbeConfig
+	configs  map[string]ProbeConfig
+	expiry   time.Duration
+	now      func() time.Time
+	targets  map[Proxy]*probeTarget
+	stop     chan struct{}
+	stopped  bool
+}
+
+type probeTarget struct {
+	lastSeen time.Time
+}
+
+// Observe the proxies from a PAC result, starting to probe any that are new
+func (p *ProxyProber) Observe(proxies Proxies) {
+	now := p.now()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stopped {
+		return
+	}
+	for _, proxy := range proxies {
+		if proxy == DirectProxy {
+			continue
+		}
+		if target, ok := p.targets[proxy]; ok {
+			target.lastSeen = now
+			continue
+		}
+		cfg := p.config(proxy)
+		if cfg.Interval <= 0 {
+			continue
+		}
+		target := &probeTarget{lastSeen: now}
+		p.targets[proxy] = target
+		log.Printf("starting to probe %q every %s", proxy, cfg.Interval)
+		go p.run(proxy, cfg, target)
+	}
+}
+
+// Stop all probing
+func (p *ProxyProber) Stop() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.stopped {
+		p.stopped = true
+		close(p.stop)
+	}
+}
+
+func (p *ProxyProber) config(proxy Proxy) ProbeConfig {
+	if cfg, ok := p.configs[proxy.Address()]; ok {
+		return cfg
+	}
+	return p.defaults
+}
+
+func (p *ProxyProber) run(proxy Proxy, cfg ProbeConfig, target *probeTarget) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+		if p.expired(proxy, target) {
+			log.Printf("stopped probing %q as it has not been seen for %s", proxy, p.expiry)
+			return
+		}
+		p.probeOnce(proxy, cfg)
+	}
+}
+
+func (p *ProxyProber) expired(proxy Proxy, target *probeTarget) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.now().Sub(target.lastSeen) < p.expiry {
+		return false
+	}
+	delete(p.targets, proxy)
+	return true
+}
+
+func (p *ProxyProber) probeOnce(proxy Proxy, cfg ProbeConfig) {
+	ctx := context.Background()
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+	if err := p.probe(ctx, proxy, cfg.Canary); err != nil {
+		log.Printf("probe of %q failed: %s", proxy, err)
+		p.checker.RecordFailure(proxy, err)
+		return
+	}
+	if !p.checker.IsHealthy(proxy) {
+		log.Printf("probe of %q succeeded", proxy)
+	}
+	p.checker.RecordSuccess(proxy)
+}
+
+// ObservedFinder passes every result found by Finder on to Observe
+type ObservedFinder struct {
+	Finder  ProxyFinder
+	Observe func(Proxies)
+}
+
+func (f *ObservedFinder) FindProxyForURL(in *url.URL) (Proxies, error) {
+	proxies, err := f.Finder.FindProxyForURL(in)
+	if err == nil {
+		f.Observe(proxies)
+	}
+	return proxies, err
+}
@@ -0,0 +1,76 @@
+package pac
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProxyProber(t *testing.T) {
+	a := Proxy{ProxyTypeHTTP, "a.example.com", 8080}
+	b := Proxy{ProxyTypeHTTP, "b.example.com", 8080}
+	probed := make(chan Proxy, 10)
+	checker := NewBadProxyList()
+	p := NewProxyProber(
+		checker,
+		func(ctx context.Context, p Proxy, canary string) error {
+			if canary != "canary.example.com:443" {
+				t.Errorf("unexpected canary %q", canary)
+			}
+			probed <- p
+			return errors.New("probe failed")
+		},
+		ProbeDefaults(ProbeConfig{
+			Interval: 10 * time.Millisecond,
+			Canary:   "canary.example.com:443",
+		}),
+		ProbeProxy(b.Address(), ProbeConfig{}),
+	)
+	defer p.Stop()
+
+	p.Observe(Proxies{DirectProxy, a, b})
+	select {
+	case got := <-probed:
+		if got != a {
+			t.Errorf("expecting %q to be probed, got %q", a, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expecting %q to be probed", a)
+	}
+	if checker.IsHealthy(a) {
+		t.Errorf("expecting the failed probe to mark %q as bad", a)
+	}
+	if !checker.IsHealthy(b) {
+		t.Errorf("expecting %q to not be probed", b)
+	}
+}
+
+func TestProxyProberExpiry(t *testing.T) {
+	a := Proxy{ProxyTypeHTTP, "a.example.com", 8080}
+	p := NewProxyProber(
+		NewBadProxyList(),
+		func(ctx context.Context, p Proxy, canary string) error {
+			return nil
+		},
+		ProbeDefaults(ProbeConfig{Interval: time.Millisecond}),
+		ProbeExpiry(time.Minute),
+	)
+	defer p.Stop()
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	p.Observe(Proxies{a})
+	p.mutex.Lock()
+	now = now.Add(time.Minute)
+	p.mutex.Unlock()
+	for i := 0; i < 100; i++ {
+		p.mutex.Lock()
+		_, ok := p.targets[a]
+		p.mutex.Unlock()
+		if !ok {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Errorf("expecting %q to stop being probed", a)
+}
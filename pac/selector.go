@@ -1,5 +1,37 @@
 package pac
 
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// OrderProxies puts from into the order that they should be tried in for a
+// URL. Selectors that are not a ProxyOrderer are asked to select from what
+// remains until there is nothing left.
+func OrderProxies(s ProxySelector, in *url.URL, from Proxies) Proxies {
+	if o, ok := s.(ProxyOrderer); ok {
+		return o.OrderProxies(in, from)
+	}
+	ordered := make(Proxies, 0, len(from))
+	for remaining := from; len(remaining) > 0; {
+		proxy := s.SelectProxy(remaining)
+		next := remaining.Without(proxy)
+		if len(next) == len(remaining) {
+			// The selector went off piste, so just use what is left as is.
+			ordered = append(ordered, remaining...)
+			break
+		}
+		ordered = append(ordered, proxy)
+		remaining = next
+	}
+	return ordered
+}
+
 // FirstItemSelector simply selects the first item or returns DirectProxy
 type FirstItemSelector struct{}
 
@@ -9,3 +41,250 @@ func (s *FirstItemSelector) SelectProxy(from Proxies) Proxy {
 	}
 	return from[0]
 }
+
+// RoundRobinSelector takes turns, starting each selection one further along
+// the list than the last.
+//
+// DIRECT entries stay where the PAC put them, only proxies are reordered.
+type RoundRobinSelector struct {
+	mutex sync.Mutex
+	next  int
+}
+
+func (s *RoundRobinSelector) SelectProxy(from Proxies) Proxy {
+	return firstOrDirect(s.OrderProxies(nil, from))
+}
+
+func (s *RoundRobinSelector) OrderProxies(in *url.URL, from Proxies) Proxies {
+	return reorderProxies(from, func(proxies Proxies) Proxies {
+		if len(proxies) < 1 {
+			return proxies
+		}
+		s.mutex.Lock()
+		offset := s.next % len(proxies)
+		s.next++
+		s.mutex.Unlock()
+		ordered := make(Proxies, 0, len(proxies))
+		ordered = append(ordered, proxies[offset:]...)
+		return append(ordered, proxies[:offset]...)
+	})
+}
+
+// NewRandomSelector instance, seeded from the current time
+func NewRandomSelector() *RandomSelector {
+	return &RandomSelector{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// RandomSelector shuffles the proxies
+//
+// DIRECT entries stay where the PAC put them, only proxies are reordered.
+type RandomSelector struct {
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+func (s *RandomSelector) SelectProxy(from Proxies) Proxy {
+	return firstOrDirect(s.OrderProxies(nil, from))
+}
+
+func (s *RandomSelector) OrderProxies(in *url.URL, from Proxies) Proxies {
+	return reorderProxies(from, func(proxies Proxies) Proxies {
+		s.mutex.Lock()
+		s.rand.Shuffle(len(proxies), func(i, j int) {
+			proxies[i], proxies[j] = proxies[j], proxies[i]
+		})
+		s.mutex.Unlock()
+		return proxies
+	})
+}
+
+// NewWeightedSelector instance, seeded from the current time. weights are
+// keyed by proxy "host:port" address, anything not listed has a weight of 1.
+func NewWeightedSelector(weights map[string]int) *WeightedSelector {
+	return &WeightedSelector{
+		weights: weights,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// WeightedSelector shuffles the proxies so that each is tried first in
+// proportion to its weight. A weight of 0 means only use it as a last resort.
+//
+// DIRECT entries stay where the PAC put them, only proxies are reordered.
+type WeightedSelector struct {
+	mutex   sync.Mutex
+	weights map[string]int
+	rand    *rand.Rand
+}
+
+func (s *WeightedSelector) SelectProxy(from Proxies) Proxy {
+	return firstOrDirect(s.OrderProxies(nil, from))
+}
+
+func (s *WeightedSelector) OrderProxies(in *url.URL, from Proxies) Proxies {
+	return reorderProxies(from, func(proxies Proxies) Proxies {
+		// Weighted random sampling without replacement, Efraimidis & Spirakis.
+		keys := make([]float64, len(proxies))
+		s.mutex.Lock()
+		for i, p := range proxies {
+			keys[i] = -1
+			if w := s.weight(p); w > 0 {
+				keys[i] = math.Pow(s.rand.Float64(), 1/float64(w))
+			}
+		}
+		s.mutex.Unlock()
+		return sortedByKey(proxies, keys)
+	})
+}
+
+func (s *WeightedSelector) weight(p Proxy) int {
+	if w, ok := s.weights[p.Address()]; ok {
+		return w
+	}
+	return 1
+}
+
+// HostHashSelector consistently picks the same proxy for the same host, so
+// that cookies and sessions stay with one egress. When the list of proxies
+// changes only the hosts that were using a removed proxy move.
+//
+// DIRECT entries stay where the PAC put them, only proxies are reordered.
+type HostHashSelector struct{}
+
+func (s *HostHashSelector) SelectProxy(from Proxies) Proxy {
+	return firstOrDirect(s.OrderProxies(nil, from))
+}
+
+func (s *HostHashSelector) OrderProxies(in *url.URL, from Proxies) Proxies {
+	// Rendezvous hashing, highest score first.
+	var host string
+	if in != nil {
+		host = in.Hostname()
+	}
+	return reorderProxies(from, func(proxies Proxies) Proxies {
+		keys := make([]float64, len(proxies))
+		for i, p := range proxies {
+			h := fnv.New64a()
+			h.Write([]byte(host))
+			h.Write([]byte{0})
+			h.Write([]byte(p.String()))
+			keys[i] = float64(h.Sum64())
+		}
+		return sortedByKey(proxies, keys)
+	})
+}
+
+// NewLatencySelector instance, seeded from the current time. alpha is the
+// EWMA smoothing factor given to each new sample and explore is the chance
+// of trying something other than the fastest proxy first.
+func NewLatencySelector(alpha, explore float64) *LatencySelector {
+	return &LatencySelector{
+		alpha:   alpha,
+		explore: explore,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		latency: make(map[Proxy]float64),
+	}
+}
+
+// LatencySelector prefers the proxy with the lowest observed connect latency,
+// as an exponentially weighted moving average. Proxies that have not been
+// measured yet are tried first so that they get measured, and every so often
+// a slower proxy is tried first so that its latency stays current.
+//
+// DIRECT entries stay where the PAC put them, only proxies are reordered.
+type LatencySelector struct {
+	mutex   sync.Mutex
+	alpha   float64
+	explore float64
+	rand    *rand.Rand
+	latency map[Proxy]float64
+}
+
+// RecordLatency implements LatencyRecorder
+func (s *LatencySelector) RecordLatency(p Proxy, d time.Duration) {
+	if p == DirectProxy {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if ewma, ok := s.latency[p]; ok {
+		s.latency[p] = s.alpha*float64(d) + (1-s.alpha)*ewma
+	} else {
+		s.latency[p] = float64(d)
+	}
+}
+
+// Latency returns the current average latency for p, if it has been measured
+func (s *LatencySelector) Latency(p Proxy) (time.Duration, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ewma, ok := s.latency[p]
+	return time.Duration(ewma), ok
+}
+
+func (s *LatencySelector) SelectProxy(from Proxies) Proxy {
+	return firstOrDirect(s.OrderProxies(nil, from))
+}
+
+func (s *LatencySelector) OrderProxies(in *url.URL, from Proxies) Proxies {
+	return reorderProxies(from, func(proxies Proxies) Proxies {
+		keys := make([]float64, len(proxies))
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		for i, p := range proxies {
+			keys[i] = math.Inf(1)
+			if ewma, ok := s.latency[p]; ok {
+				keys[i] = -ewma
+			}
+		}
+		proxies = sortedByKey(proxies, keys)
+		if len(proxies) > 1 && s.rand.Float64() < s.explore {
+			i := 1 + s.rand.Intn(len(proxies)-1)
+			explore := proxies[i]
+			copy(proxies[1:i+1], proxies[:i])
+			proxies[0] = explore
+		}
+		return proxies
+	})
+}
+
+// reorderProxies returns from with its proxies put into the order that
+// order returns them in, so that DIRECT entries stay where the PAC put them
+// and only ever act as the fallback that it asked for
+func reorderProxies(from Proxies, order func(proxies Proxies) Proxies) Proxies {
+	proxies := order(from.Without(DirectProxy))
+	ordered := make(Proxies, len(from))
+	for i, p := range from {
+		if p == DirectProxy {
+			ordered[i] = p
+		} else {
+			ordered[i], proxies = proxies[0], proxies[1:]
+		}
+	}
+	return ordered
+}
+
+// sortedByKey returns a copy of from ordered by descending key
+func sortedByKey(from Proxies, keys []float64) Proxies {
+	idx := make([]int, len(from))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return keys[idx[i]] > keys[idx[j]]
+	})
+	ordered := make(Proxies, len(from))
+	for i, j := range idx {
+		ordered[i] = from[j]
+	}
+	return ordered
+}
+
+func firstOrDirect(from Proxies) Proxy {
+	if len(from) < 1 {
+		return DirectProxy
+	}
+	return from[0]
+}
@@ -0,0 +1,224 @@
+package pac
+
+import (
+	"math/rand"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var (
+	selectorA = Proxy{ProxyTypeHTTP, "a.example.com", 8080}
+	selectorB = Proxy{ProxyTypeHTTP, "b.example.com", 8080}
+	selectorC = Proxy{ProxyTypeHTTP, "c.example.com", 8080}
+	selectorD = Proxy{ProxyTypeHTTP, "d.example.com", 8080}
+)
+
+func assertOrder(t *testing.T, name string, got Proxies, expected Proxies) {
+	if got.String() != expected.String() {
+		t.Errorf("%s expected order %q, got %q", name, expected, got)
+	}
+}
+
+func assertPermutation(t *testing.T, name string, got Proxies, of Proxies) {
+	if len(got) != len(of) {
+		t.Errorf("%s expected %d proxies, got %q", name, len(of), got)
+		return
+	}
+	for _, p := range of {
+		if len(got.Without(p)) != len(got)-1 {
+			t.Errorf("%s expected %q to appear once, got %q", name, p, got)
+		}
+	}
+}
+
+func TestOrderProxiesWithFirstItemSelector(t *testing.T) {
+	from := Proxies{selectorA, selectorB, DirectProxy}
+	assertOrder(t, "first", OrderProxies(&FirstItemSelector{}, nil, from), from)
+	assertOrder(t, "first", OrderProxies(&FirstItemSelector{}, nil, Proxies{}), Proxies{})
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	s := &RoundRobinSelector{}
+	from := Proxies{selectorA, selectorB, selectorC}
+	assertOrder(t, "round robin", OrderProxies(s, nil, from), Proxies{selectorA, selectorB, selectorC})
+	assertOrder(t, "round robin", OrderProxies(s, nil, from), Proxies{selectorB, selectorC, selectorA})
+	assertOrder(t, "round robin", OrderProxies(s, nil, from), Proxies{selectorC, selectorA, selectorB})
+	if p := s.SelectProxy(from); p != selectorA {
+		t.Errorf("expected %q, got %q", selectorA, p)
+	}
+	if p := s.SelectProxy(Proxies{}); p != DirectProxy {
+		t.Errorf("expected %q, got %q", DirectProxy, p)
+	}
+}
+
+func TestRandomSelector(t *testing.T) {
+	s := &RandomSelector{rand: rand.New(rand.NewSource(1))}
+	from := Proxies{selectorA, selectorB, selectorC, selectorD}
+	first := make(map[Proxy]int)
+	for i := 0; i < 400; i++ {
+		ordered := OrderProxies(s, nil, from)
+		assertPermutation(t, "random", ordered, from)
+		first[ordered[0]]++
+	}
+	for _, p := range from {
+		if first[p] < 50 {
+			t.Errorf("expected %q to be first more often, got %d of 400", p, first[p])
+		}
+	}
+}
+
+func TestWeightedSelector(t *testing.T) {
+	s := NewWeightedSelector(map[string]int{
+		selectorA.Address(): 9,
+		selectorC.Address(): 0,
+	})
+	s.rand = rand.New(rand.NewSource(1))
+	from := Proxies{selectorA, selectorB, selectorC}
+	first := make(map[Proxy]int)
+	for i := 0; i < 1000; i++ {
+		ordered := OrderProxies(s, nil, from)
+		assertPermutation(t, "weighted", ordered, from)
+		if ordered[2] != selectorC {
+			t.Errorf("expected %q with a weight of 0 to be last, got %q", selectorC, ordered)
+		}
+		first[ordered[0]]++
+	}
+	if first[selectorA] < 850 || first[selectorA] > 950 {
+		t.Errorf("expected %q to be first about 900 times in 1000, got %d", selectorA, first[selectorA])
+	}
+}
+
+func TestHostHashSelector(t *testing.T) {
+	s := &HostHashSelector{}
+	from := Proxies{selectorA, selectorB, selectorC, selectorD}
+	moved := 0
+	for _, host := range []string{"a.test", "b.test", "c.test", "d.test", "e.test", "f.test", "g.test", "h.test"} {
+		u, _ := url.Parse("http://" + host + "/page.html")
+		ordered := OrderProxies(s, u, from)
+		assertPermutation(t, "host hash", ordered, from)
+		again, _ := url.Parse("https://" + host + "/other.html")
+		assertOrder(t, "host hash", OrderProxies(s, again, from), ordered)
+		// Removing a proxy should only move the hosts that were using it.
+		without := OrderProxies(s, u, from.Without(selectorB))
+		assertOrder(t, "host hash", without, ordered.Without(selectorB))
+		if ordered[0] == selectorB {
+			moved++
+		}
+	}
+	if moved == 0 || moved == 8 {
+		t.Errorf("expected hosts to be spread over the proxies")
+	}
+}
+
+// assertDirectStays checks that s only ever reorders the proxies in a list
+// that has DIRECT in it, so that DIRECT stays the PAC's last resort
+func assertDirectStays(t *testing.T, name string, s ProxySelector) {
+	from := Proxies{selectorA, selectorB, DirectProxy}
+	first := make(map[Proxy]int)
+	for i, host := range []string{"a.test", "b.test", "c.test", "d.test", "e.test", "f.test", "g.test", "h.test"} {
+		u, _ := url.Parse("http://" + host + "/page.html")
+		ordered := OrderProxies(s, u, from)
+		assertPermutation(t, name, ordered, from)
+		if ordered[2] != DirectProxy {
+			t.Errorf("%s expected %q to stay last on %d, got %q", name, DirectProxy, i, ordered)
+		}
+		first[ordered[0]]++
+	}
+	if p := s.SelectProxy(from); p == DirectProxy {
+		t.Errorf("%s expected a proxy to be selected over %q", name, DirectProxy)
+	}
+	if first[selectorA] == 0 || first[selectorB] == 0 {
+		t.Errorf("%s expected both proxies to be tried first, got %v", name, first)
+	}
+	ordered := OrderProxies(s, nil, Proxies{DirectProxy, selectorA, selectorB})
+	if ordered[0] != DirectProxy {
+		t.Errorf("%s expected %q to stay first, got %q", name, DirectProxy, ordered)
+	}
+	assertOrder(t, name, OrderProxies(s, nil, Proxies{DirectProxy}), Proxies{DirectProxy})
+}
+
+func TestRoundRobinSelectorKeepsDirect(t *testing.T) {
+	assertDirectStays(t, "round robin", &RoundRobinSelector{})
+	s := &RoundRobinSelector{}
+	from := Proxies{selectorA, DirectProxy, selectorB}
+	assertOrder(t, "round robin", OrderProxies(s, nil, from), Proxies{selectorA, DirectProxy, selectorB})
+	assertOrder(t, "round robin", OrderProxies(s, nil, from), Proxies{selectorB, DirectProxy, selectorA})
+}
+
+func TestRandomSelectorKeepsDirect(t *testing.T) {
+	assertDirectStays(t, "random", &RandomSelector{rand: rand.New(rand.NewSource(1))})
+}
+
+func TestWeightedSelectorKeepsDirect(t *testing.T) {
+	s := NewWeightedSelector(map[string]int{
+		selectorA.Address(): 1,
+		selectorB.Address(): 1,
+	})
+	s.rand = rand.New(rand.NewSource(1))
+	assertDirectStays(t, "weighted", s)
+	s = NewWeightedSelector(map[string]int{
+		selectorA.Address(): 0,
+	})
+	s.rand = rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		assertOrder(t, "weighted", OrderProxies(s, nil, Proxies{selectorA, DirectProxy}), Proxies{selectorA, DirectProxy})
+	}
+}
+
+func TestHostHashSelectorKeepsDirect(t *testing.T) {
+	assertDirectStays(t, "host hash", &HostHashSelector{})
+}
+
+func TestCheckedSelectorOrderProxies(t *testing.T) {
+	l := NewBadProxyList()
+	s := &CheckedSelector{
+		Selector: &RoundRobinSelector{},
+		Checker:  l,
+	}
+	l.RecordFailure(selectorA, nil)
+	from := Proxies{selectorA, selectorB, selectorC}
+	assertOrder(t, "checked", OrderProxies(s, nil, from), Proxies{selectorB, selectorC, selectorA})
+	assertOrder(t, "checked", OrderProxies(s, nil, from), Proxies{selectorB, selectorC, selectorA})
+	assertOrder(t, "checked", OrderProxies(s, nil, from), Proxies{selectorC, selectorB, selectorA})
+}
+
+func TestLatencySelector(t *testing.T) {
+	s := NewLatencySelector(0.5, 0)
+	from := Proxies{selectorA, DirectProxy, selectorB, selectorC}
+	assertOrder(t, "latency", OrderProxies(s, nil, from), from)
+
+	s.RecordLatency(selectorA, 30*time.Millisecond)
+	s.RecordLatency(selectorB, 10*time.Millisecond)
+	assertOrder(t, "latency", OrderProxies(s, nil, from), Proxies{selectorC, DirectProxy, selectorB, selectorA})
+
+	s.RecordLatency(selectorC, 20*time.Millisecond)
+	assertOrder(t, "latency", OrderProxies(s, nil, from), Proxies{selectorB, DirectProxy, selectorC, selectorA})
+
+	s.RecordLatency(selectorB, 50*time.Millisecond)
+	if d, ok := s.Latency(selectorB); !ok || d != 30*time.Millisecond {
+		t.Errorf("expected an average latency of 30ms for %q, got %s", selectorB, d)
+	}
+	assertOrder(t, "latency", OrderProxies(s, nil, from), Proxies{selectorC, DirectProxy, selectorA, selectorB})
+	if p := s.SelectProxy(from); p != selectorC {
+		t.Errorf("expected %q, got %q", selectorC, p)
+	}
+}
+
+func TestLatencySelectorExplore(t *testing.T) {
+	s := NewLatencySelector(0.5, 1)
+	s.rand = rand.New(rand.NewSource(1))
+	s.RecordLatency(selectorA, 10*time.Millisecond)
+	s.RecordLatency(selectorB, 20*time.Millisecond)
+	s.RecordLatency(selectorC, 30*time.Millisecond)
+	from := Proxies{selectorA, selectorB, selectorC}
+	first := make(map[Proxy]int)
+	for i := 0; i < 100; i++ {
+		ordered := OrderProxies(s, nil, from)
+		assertPermutation(t, "latency", ordered, from)
+		first[ordered[0]]++
+	}
+	if first[selectorA] != 0 || first[selectorB] == 0 || first[selectorC] == 0 {
+		t.Errorf("expected slower proxies to be explored, got %v", first)
+	}
+}
@@ -0,0 +1,98 @@
+package pac
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Source of a PAC, named for logs and status output
+type Source struct {
+	Name string
+	Load Loader
+}
+
+// NewSmartSource for a PAC that SmartLoader would load from thing
+func NewSmartSource(thing string) Source {
+	name := thing
+	if _, err := ParseFindProxyString(thing); err != nil && isJavascript(thing) {
+		name = "javascript"
+	}
+	return Source{
+		Name: name,
+		Load: smartLoader(thing),
+	}
+}
+
+// Validator checks that the PAC loaded from the named source can be run by
+// the engine that will be given it
+type Validator func(name, pac string) error
+
+// NewSourceList instance that loads from the first of sources that works.
+// When validate is not nil it is used to check each PAC as it is loaded.
+func NewSourceList(validate Validator, sources ...Source) *SourceList {
+	return &SourceList{
+		validate: validate,
+		sources:  sources,
+	}
+}
+
+// SourceList loads a PAC from each of its sources in order, using the first
+// one that both loads and is valid. The source only becomes the active one
+// once its PAC is passed to Commit.
+type SourceList struct {
+	mutex      sync.RWMutex
+	validate   Validator
+	sources    []Source
+	active     string
+	loaded     string
+	loadedFrom string
+}
+
+// Load implements Loader
+func (l *SourceList) Load() (string, error) {
+	var errs []string
+	for _, source := range l.sources {
+		pac, err := source.Load()
+		if err == nil && l.validate != nil {
+			err = l.validate(source.Name, pac)
+		}
+		if err != nil {
+			log.Printf("failed to load PAC from %q: %s", source.Name, err)
+			errs = append(errs, fmt.Sprintf("%s: %s", source.Name, err))
+			continue
+		}
+		l.mutex.Lock()
+		l.loaded, l.loadedFrom = pac, source.Name
+		l.mutex.Unlock()
+		return pac, nil
+	}
+	if len(errs) == 1 {
+		return "", errors.New(errs[0])
+	}
+	return "", fmt.Errorf("no PAC could be loaded from any of its sources: %s", strings.Join(errs, "; "))
+}
+
+// Commit makes the source that the last Load got pac from the active one.
+// Pass it to the engine's commit option so that a source only becomes active
+// once the engine accepts its PAC.
+func (l *SourceList) Commit(pac string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.loadedFrom == "" || pac != l.loaded {
+		return
+	}
+	if l.active != l.loadedFrom {
+		log.Printf("using PAC from %q", l.loadedFrom)
+	}
+	l.active = l.loadedFrom
+}
+
+// Active returns the name of the source that the PAC in use was loaded from
+func (l *SourceList) Active() string {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.active
+}
@@ -0,0 +1,125 @@
+package pac
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSourceList(t *testing.T) {
+	primary := Source{
+		Name: "primary",
+		Load: func() (string, error) {
+			return "", errors.New("unreachable")
+		},
+	}
+	broken := Source{
+		Name: "broken",
+		Load: func() (string, error) {
+			return "function FindProxyForURL(url, host){ return 'DIRECT'", nil
+		},
+	}
+	l := NewSourceList(ValidateOtto, primary, broken, NewSmartSource("PROXY proxy.example.com:8080; DIRECT"), NewSmartSource("DIRECT"))
+	pac, err := l.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %q", err)
+	}
+	if l.Active() != "" {
+		t.Errorf("expecting no active source until the PAC is committed, got %q", l.Active())
+	}
+	l.Commit(pac)
+	if l.Active() != "PROXY proxy.example.com:8080; DIRECT" {
+		t.Errorf("unexpected active source %q", l.Active())
+	}
+	assertOtto(
+		t,
+		pac,
+		"http://www.example.com/",
+		[]Proxy{Proxy{ProxyTypeHTTP, "proxy.example.com", 8080}, DirectProxy},
+		"",
+	)
+}
+
+func TestSourceListErrors(t *testing.T) {
+	l := NewSourceList(ValidateOtto, NewSmartSource("/does/not/exist.pac"), NewSmartSource("function FindProxyForURL(url, host){"))
+	_, err := l.Load()
+	e := "no PAC could be loaded from any of its sources: /does/not/exist.pac: open /does/not/exist.pac: no such file or directory; javascript: javascript: Line 1:37 Unexpected end of input"
+	if err == nil || err.Error() != e {
+		t.Errorf("expecting error %q, got %v", e, err)
+	}
+	if l.Active() != "" {
+		t.Errorf("unexpected active source %q", l.Active())
+	}
+}
+
+func TestSourceListValidatesWithTheEngine(t *testing.T) {
+	modern := Source{
+		Name: "modern",
+		Load: func() (string, error) {
+			return "const FindProxyForURL = (url, host) => `PROXY ${host}:8080`;", nil
+		},
+	}
+	fallback := NewSmartSource("DIRECT")
+	tests := []struct {
+		name     string
+		validate Validator
+		active   string
+	}{
+		{"otto", ValidateOtto, "DIRECT"},
+		{"goja", ValidateGoja, "modern"},
+		{"none", nil, "modern"},
+	}
+	for _, tt := range tests {
+		l := NewSourceList(tt.validate, modern, fallback)
+		pac, err := l.Load()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %q", tt.name, err)
+		}
+		l.Commit(pac)
+		if l.Active() != tt.active {
+			t.Errorf("%s: expecting the PAC from %q, got %q", tt.name, tt.active, l.Active())
+		}
+	}
+}
+
+func TestSourceListWithoutFindProxyForURL(t *testing.T) {
+	noFunc := Source{
+		Name: "no function",
+		Load: func() (string, error) {
+			return "var proxy = 'PROXY proxy.example.com:8080';", nil
+		},
+	}
+	tests := []struct {
+		name     string
+		validate Validator
+	}{
+		{"otto", ValidateOtto},
+		{"goja", ValidateGoja},
+	}
+	for _, tt := range tests {
+		l := NewSourceList(tt.validate, noFunc, NewSmartSource("DIRECT"))
+		pac, err := l.Load()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %q", tt.name, err)
+		}
+		l.Commit(pac)
+		if l.Active() != "DIRECT" {
+			t.Errorf("%s: expecting the PAC from %q, got %q", tt.name, "DIRECT", l.Active())
+		}
+	}
+}
+
+func TestSourceListCommit(t *testing.T) {
+	l := NewSourceList(nil, NewSmartSource("DIRECT"))
+	pac, err := l.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %q", err)
+	}
+	l.Commit("function FindProxyForURL(url, host){ return 'PROXY other.example.com:8080'; }")
+	if l.Active() != "" {
+		t.Errorf("expecting a PAC that was not loaded to not make a source active, got %q", l.Active())
+	}
+	l.Commit(pac)
+	if l.Active() != "DIRECT" {
+		t.Errorf("expecting the PAC from %q, got %q", "DIRECT", l.Active())
+	}
+}
@@ -0,0 +1,86 @@
+package pac
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnverified is returned, wrapped, by loaders that refuse a PAC because it
+// failed verification
+var ErrUnverified = errors.New("PAC failed verification")
+
+// SHA256Loader only returns the PAC that loader loads when its SHA-256 is
+// one of sums, given in hex. Pinning more than one sum allows a PAC to be
+// rolled over.
+func SHA256Loader(loader Loader, sums ...string) Loader {
+	pinned := make(map[string]bool, len(sums))
+	for _, sum := range sums {
+		pinned[strings.ToLower(strings.TrimSpace(sum))] = true
+	}
+	return func() (string, error) {
+		pac, err := loader()
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256([]byte(pac))
+		if !pinned[hex.EncodeToString(sum[:])] {
+			return "", fmt.Errorf("%w: its SHA-256 %x is not pinned", ErrUnverified, sum)
+		}
+		return pac, nil
+	}
+}
+
+// Ed25519Loader only returns the PAC that loader loads when signature loads
+// a detached Ed25519 signature of it made with the private half of key. The
+// signature may be raw or base64 encoded.
+func Ed25519Loader(loader Loader, signature Loader, key ed25519.PublicKey) Loader {
+	return func() (string, error) {
+		pac, err := loader()
+		if err != nil {
+			return "", err
+		}
+		s, err := signature()
+		if err != nil {
+			return "", fmt.Errorf("%w: failed to load its signature: %s", ErrUnverified, err)
+		}
+		sig, err := decodeKeyMaterial(s, ed25519.SignatureSize)
+		if err != nil {
+			return "", fmt.Errorf("%w: bad signature: %s", ErrUnverified, err)
+		}
+		if !ed25519.Verify(key, []byte(pac), sig) {
+			return "", fmt.Errorf("%w: bad signature", ErrUnverified)
+		}
+		return pac, nil
+	}
+}
+
+// ParseEd25519PublicKey from its raw, hex or base64 encoding
+func ParseEd25519PublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := decodeKeyMaterial(s, ed25519.PublicKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("bad Ed25519 public key: %s", err)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// decodeKeyMaterial of size bytes that may be raw, hex or base64 encoded
+func decodeKeyMaterial(s string, size int) ([]byte, error) {
+	if len(s) == size {
+		return []byte(s), nil
+	}
+	s = strings.TrimSpace(s)
+	if b, err := hex.DecodeString(s); err == nil && len(b) == size {
+		return b, nil
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(s); err == nil && len(b) == size {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("expecting %d bytes, either raw or hex or base64 encoded", size)
+}
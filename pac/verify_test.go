@@ -0,0 +1,81 @@
+package pac
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func staticLoader(s string) Loader {
+	return func() (string, error) {
+		return s, nil
+	}
+}
+
+func TestSHA256Loader(t *testing.T) {
+	sum := sha256.Sum256([]byte(DirectPAC))
+	pinned := hex.EncodeToString(sum[:])
+
+	pac, err := SHA256Loader(staticLoader(DirectPAC), "00", pinned)()
+	if err != nil || pac != DirectPAC {
+		t.Errorf("unexpected load %q, %v", pac, err)
+	}
+	pac, err = SHA256Loader(staticLoader(DirectPAC+" "), pinned)()
+	if !errors.Is(err, ErrUnverified) || pac != "" {
+		t.Errorf("expecting an unverified error, got %q, %v", pac, err)
+	}
+	loadErr := errors.New("boom")
+	_, err = SHA256Loader(func() (string, error) { return "", loadErr }, pinned)()
+	if err != loadErr {
+		t.Errorf("expecting the load error, got %v", err)
+	}
+}
+
+func TestEd25519Loader(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := ed25519.Sign(private, []byte(DirectPAC))
+
+	for name, encoded := range map[string]string{
+		"raw":    string(sig),
+		"hex":    hex.EncodeToString(sig) + "\n",
+		"base64": base64.StdEncoding.EncodeToString(sig) + "\n",
+	} {
+		pac, err := Ed25519Loader(staticLoader(DirectPAC), staticLoader(encoded), public)()
+		if err != nil || pac != DirectPAC {
+			t.Errorf("%s: unexpected load %q, %v", name, pac, err)
+		}
+	}
+
+	for name, l := range map[string]Loader{
+		"tampered":  Ed25519Loader(staticLoader(DirectPAC+" "), staticLoader(string(sig)), public),
+		"garbage":   Ed25519Loader(staticLoader(DirectPAC), staticLoader("not a signature"), public),
+		"no sig":    Ed25519Loader(staticLoader(DirectPAC), func() (string, error) { return "", errors.New("404") }, public),
+		"wrong key": Ed25519Loader(staticLoader(DirectPAC), staticLoader(string(sig)), make(ed25519.PublicKey, ed25519.PublicKeySize)),
+	} {
+		pac, err := l()
+		if !errors.Is(err, ErrUnverified) || pac != "" {
+			t.Errorf("%s: expecting an unverified error, got %q, %v", name, pac, err)
+		}
+	}
+}
+
+func TestParseEd25519PublicKey(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParseEd25519PublicKey(base64.StdEncoding.EncodeToString(public))
+	if err != nil || !bytes.Equal(key, public) {
+		t.Errorf("unexpected key %x, %v", key, err)
+	}
+	if _, err := ParseEd25519PublicKey("c2hvcnQ="); err == nil {
+		t.Errorf("expecting an error for a short key")
+	}
+}
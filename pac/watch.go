@@ -0,0 +1,181 @@
+package pac
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileWatcherOpt used to configure a FileWatcher via the NewFileWatcher func
+type FileWatcherOpt func(*FileWatcher)
+
+// WatchDebounce sets how long the file has to be left alone after a change
+// before the engine is reloaded
+func WatchDebounce(d time.Duration) FileWatcherOpt {
+	return func(w *FileWatcher) {
+		w.debounce = d
+	}
+}
+
+// WatchPollInterval sets how often the file is checked when it can not be
+// watched using the operating system
+func WatchPollInterval(d time.Duration) FileWatcherOpt {
+	return func(w *FileWatcher) {
+		w.poll = d
+	}
+}
+
+// NewFileWatcher instance with configuration
+func NewFileWatcher(file string, manager EngineManager, opts ...FileWatcherOpt) *FileWatcher {
+	w := &FileWatcher{
+		file:     file,
+		manager:  manager,
+		debounce: 500 * time.Millisecond,
+		poll:     2 * time.Second,
+		notify:   newFileNotifier,
+		stop:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// FileWatcher reloads an engine whenever the content of a PAC file changes.
+// It uses inotify where available and falls back to polling the file's
+// modification time and size. Either way the engine is only reloaded once
+// the file has been left alone for a while, and its hash has changed.
+type FileWatcher struct {
+	file     string
+	manager  EngineManager
+	debounce time.Duration
+	poll     time.Duration
+	notify   func(file string) (<-chan struct{}, func() error, error)
+	stop     chan struct{}
+	stopOnce sync.Once
+	last     fileState
+}
+
+type fileState struct {
+	exists  bool
+	modTime time.Time
+	size    int64
+	sum     [sha256.Size]byte
+}
+
+// Start watching the file
+func (w *FileWatcher) Start() {
+	w.last = readFileState(w.file, fileState{})
+	events, closer, err := w.notify(w.file)
+	if err != nil {
+		log.Printf("polling PAC file %q for changes every %s: %s", w.file, w.poll, err)
+		events, closer = nil, nil
+	} else {
+		log.Printf("watching PAC file %q for changes", w.file)
+	}
+	go w.run(events, closer)
+}
+
+// Stop watching the file
+func (w *FileWatcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+}
+
+func (w *FileWatcher) run(events <-chan struct{}, closer func() error) {
+	if closer != nil {
+		defer closer()
+	}
+	var poll <-chan time.Time
+	if events == nil {
+		ticker := time.NewTicker(w.poll)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	polled := statFile(w.file)
+	debounce := time.NewTimer(w.debounce)
+	debounce.Stop()
+	defer debounce.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case _, ok := <-events:
+			if !ok {
+				log.Printf("stopped receiving changes to PAC file %q, polling every %s instead", w.file, w.poll)
+				events = nil
+				ticker := time.NewTicker(w.poll)
+				defer ticker.Stop()
+				poll = ticker.C
+				continue
+			}
+			debounce.Reset(w.debounce)
+		case <-poll:
+			if state := statFile(w.file); state != polled {
+				polled = state
+				debounce.Reset(w.debounce)
+			}
+		case <-debounce.C:
+			w.check()
+		}
+	}
+}
+
+// check reloads the engine if the content of the file has changed
+func (w *FileWatcher) check() {
+	state := readFileState(w.file, w.last)
+	last := w.last
+	w.last = state
+	switch {
+	case !state.exists && last.exists:
+		log.Printf("PAC file %q has gone away, keeping the current PAC", w.file)
+		return
+	case !state.exists || state.sum == last.sum:
+		return
+	}
+	log.Printf(
+		"PAC file %q changed, %d bytes modified at %s with sha256 %x, was %d bytes modified at %s with sha256 %x",
+		w.file,
+		state.size, state.modTime.Format(time.RFC3339Nano), state.sum,
+		last.size, last.modTime.Format(time.RFC3339Nano), last.sum,
+	)
+	if err := w.manager.Reload(); err != nil {
+		log.Printf("failed to reload changed PAC file %q: %s", w.file, err)
+	}
+}
+
+// readFileState only reads and hashes the file when its modification time or
+// size differ from last
+func readFileState(file string, last fileState) fileState {
+	state := statFile(file)
+	if !state.exists {
+		return state
+	}
+	if last.exists && state.modTime.Equal(last.modTime) && state.size == last.size {
+		state.sum = last.sum
+		return state
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return last
+	}
+	state.sum = sha256.Sum256(buf)
+	return state
+}
+
+// statFile returns the state of file without its hash
+func statFile(file string) fileState {
+	info, err := os.Stat(file)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{
+		exists:  true,
+		modTime: info.ModTime(),
+		size:    info.Size(),
+	}
+}
@@ -0,0 +1,43 @@
+// +build linux
+
+package pac
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// newFileNotifier uses inotify to signal changes to file. The directory is
+// watched rather than the file so that editors which replace the file,
+// rather than writing to it, are noticed too.
+func newFileNotifier(file string) (<-chan struct{}, func() error, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("inotify_init1", err)
+	}
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+		syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO)
+	if _, err := syscall.InotifyAddWatch(fd, filepath.Dir(file), mask); err != nil {
+		syscall.Close(fd)
+		return nil, nil, os.NewSyscallError("inotify_add_watch", err)
+	}
+	f := os.NewFile(uintptr(fd), "inotify")
+	events := make(chan struct{}, 1)
+	go func() {
+		defer close(events)
+		// The events themselves are not needed as the file is checked
+		// for changes to its content anyway.
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			if _, err := f.Read(buf); err != nil {
+				return
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return events, f.Close, nil
+}
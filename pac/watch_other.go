@@ -0,0 +1,9 @@
+// +build !linux
+
+package pac
+
+import "errors"
+
+func newFileNotifier(file string) (<-chan struct{}, func() error, error) {
+	return nil, nil, errors.New("file notifications are not supported on this platform")
+}
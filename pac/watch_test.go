@@ -0,0 +1,77 @@
+package pac
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type reloadNotifier struct {
+	reloads chan struct{}
+}
+
+func (m *reloadNotifier) Start() error { return nil }
+func (m *reloadNotifier) Stop() error  { return nil }
+func (m *reloadNotifier) Reload() error {
+	m.reloads <- struct{}{}
+	return nil
+}
+
+func assertFileWatcherReloads(t *testing.T, notify func(string) (<-chan struct{}, func() error, error)) {
+	dir, err := ioutil.TempDir("", "pacwatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "proxy.pac")
+	if err := ioutil.WriteFile(file, []byte(DirectPAC), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := &reloadNotifier{reloads: make(chan struct{}, 10)}
+	w := NewFileWatcher(file, m, WatchDebounce(20*time.Millisecond), WatchPollInterval(10*time.Millisecond))
+	w.notify = notify
+	w.Start()
+	defer w.Stop()
+
+	// writing the same content should not reload
+	if err := ioutil.WriteFile(file, []byte(DirectPAC), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-m.reloads:
+		t.Errorf("not expecting a reload when the content is unchanged")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// replace the file the way that editors do
+	tmp := filepath.Join(dir, "proxy.pac.tmp")
+	if err := ioutil.WriteFile(tmp, []byte("function FindProxyForURL(url, host){ return 'PROXY proxy.example.com:8080'; }"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-m.reloads:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expecting a reload when the content changes")
+	}
+	select {
+	case <-m.reloads:
+		t.Errorf("expecting changes to be debounced into a single reload")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestFileWatcherNotify(t *testing.T) {
+	assertFileWatcherReloads(t, newFileNotifier)
+}
+
+func TestFileWatcherPoll(t *testing.T) {
+	assertFileWatcherReloads(t, func(string) (<-chan struct{}, func() error, error) {
+		return nil, nil, errors.New("not supported")
+	})
+}
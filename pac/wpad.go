@@ -0,0 +1,218 @@
+package pac
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/williambailey/pacproxy/pacfunc"
+	"golang.org/x/net/publicsuffix"
+)
+
+// HostResolver looks up the addresses of a host, as net.Resolver does
+type HostResolver = pacfunc.Resolver
+
+// WPADLoaderOpt used to configure a WPADLoader via the NewWPADLoader func
+type WPADLoaderOpt func(*WPADLoader)
+
+// WPADResolver used to look up, and connect to, wpad hosts
+func WPADResolver(r HostResolver) WPADLoaderOpt {
+	return func(w *WPADLoader) {
+		w.resolver = r
+	}
+}
+
+// WPADSearchDomains returns the domains to search for a wpad host in,
+// instead of the system's DNS search list
+func WPADSearchDomains(fn func() ([]string, error)) WPADLoaderOpt {
+	return func(w *WPADLoader) {
+		w.searchDomains = fn
+	}
+}
+
+// WPADHTTPClient used to fetch wpad.dat
+func WPADHTTPClient(c *http.Client) WPADLoaderOpt {
+	return func(w *WPADLoader) {
+		w.client = c
+	}
+}
+
+// WPADTimeout for each lookup and fetch
+func WPADTimeout(d time.Duration) WPADLoaderOpt {
+	return func(w *WPADLoader) {
+		w.timeout = d
+	}
+}
+
+// WPADVerify wraps the loader of each PAC that is found, such as with
+// SHA256Loader or Ed25519Loader, so that a PAC is only used when it passes
+// verification. u is where the PAC was found and fetch loads other URLs,
+// such as a signature, in the same way.
+func WPADVerify(fn func(load Loader, u *url.URL, fetch func(u *url.URL) Loader) Loader) WPADLoaderOpt {
+	return func(w *WPADLoader) {
+		w.verify = fn
+	}
+}
+
+// NewWPADLoader instance with configuration
+func NewWPADLoader(opts ...WPADLoaderOpt) *WPADLoader {
+	w := &WPADLoader{
+		resolver:      net.DefaultResolver,
+		searchDomains: SystemSearchDomains,
+		timeout:       5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.client == nil {
+		w.client = &http.Client{
+			Timeout: w.timeout,
+			Transport: &http.Transport{
+				DialContext: w.dial,
+			},
+		}
+	}
+	return w
+}
+
+// WPADLoader finds a PAC the way that browsers do using DNS, by fetching
+// wpad.dat from the first wpad.<domain> host that resolves. Each domain in
+// the DNS search list is tried, walking up its labels.
+type WPADLoader struct {
+	resolver      HostResolver
+	searchDomains func() ([]string, error)
+	client        *http.Client
+	timeout       time.Duration
+	verify        func(load Loader, u *url.URL, fetch func(u *url.URL) Loader) Loader
+}
+
+// Load implements Loader
+func (w *WPADLoader) Load() (string, error) {
+	domains, err := w.searchDomains()
+	if err != nil {
+		return "", err
+	}
+	for _, host := range wpadHosts(domains) {
+		ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+		_, err := w.resolver.LookupHost(ctx, host)
+		cancel()
+		if err != nil {
+			log.Printf("wpad: no PAC at %q: %s", host, err)
+			continue
+		}
+		u := &url.URL{Scheme: "http", Host: host, Path: "/wpad.dat"}
+		load := w.fetch(u)
+		if w.verify != nil {
+			load = w.verify(load, u, w.fetch)
+		}
+		pac, err := load()
+		if err != nil {
+			log.Printf("wpad: no PAC at %q: %s", host, err)
+			continue
+		}
+		log.Printf("wpad: found PAC at %q", u)
+		return pac, nil
+	}
+	return "", fmt.Errorf("no wpad.dat found for the DNS search domains %q", domains)
+}
+
+// fetch loads u using the wpad client
+func (w *WPADLoader) fetch(u *url.URL) Loader {
+	return NewHTTPSource(u, HTTPClient(w.client)).Load
+}
+
+// dial addr using the resolver
+func (w *WPADLoader) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := w.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// wpadHosts to try for domains, most specific first. It stops at the
+// registrable domain, one label below the public suffix, so that neither
+// wpad.<tld> nor the likes of wpad.co.uk are ever tried.
+func wpadHosts(domains []string) []string {
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, domain := range domains {
+		domain = strings.Trim(strings.ToLower(domain), ".")
+		registrable, err := publicsuffix.EffectiveTLDPlusOne(domain)
+		if err != nil {
+			continue
+		}
+		labels := strings.Split(domain, ".")
+		for i := range labels {
+			suffix := strings.Join(labels[i:], ".")
+			host := "wpad." + suffix
+			if !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+			if suffix == registrable {
+				break
+			}
+		}
+	}
+	return hosts
+}
+
+// SystemSearchDomains returns the DNS search list from /etc/resolv.conf,
+// falling back to the domain of the host name.
+func SystemSearchDomains() ([]string, error) {
+	var domains []string
+	if f, err := os.Open("/etc/resolv.conf"); err == nil {
+		domains = parseSearchDomains(f)
+		f.Close()
+	}
+	if len(domains) == 0 {
+		if hostname, err := os.Hostname(); err == nil {
+			if i := strings.Index(hostname, "."); i > 0 {
+				domains = append(domains, hostname[i+1:])
+			}
+		}
+	}
+	if len(domains) == 0 {
+		return nil, errors.New("no DNS search domains found")
+	}
+	return domains, nil
+}
+
+// parseSearchDomains from resolv.conf, where the last domain or search line
+// wins
+func parseSearchDomains(r io.Reader) []string {
+	var domains []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "domain", "search":
+			domains = fields[1:]
+		}
+	}
+	return domains
+}
@@ -0,0 +1,160 @@
+package pac
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/williambailey/pacproxy/pacfunc"
+)
+
+func TestWPADHosts(t *testing.T) {
+	got := wpadHosts([]string{"Office.Example.CO.", "example.co", "local"})
+	e := "wpad.office.example.co wpad.example.co"
+	if strings.Join(got, " ") != e {
+		t.Errorf("expecting %q, got %q", e, got)
+	}
+}
+
+func TestWPADHostsStopAtThePublicSuffix(t *testing.T) {
+	tests := []struct {
+		domains []string
+		hosts   string
+	}{
+		{[]string{"dept.office.example.co.uk"}, "wpad.dept.office.example.co.uk wpad.office.example.co.uk wpad.example.co.uk"},
+		{[]string{"example.co.uk"}, "wpad.example.co.uk"},
+		{[]string{"co.uk", "uk"}, ""},
+		{[]string{"office.example.com.au", "example.com"}, "wpad.office.example.com.au wpad.example.com.au wpad.example.com"},
+		{[]string{"corp.internal"}, "wpad.corp.internal"},
+	}
+	for _, tt := range tests {
+		got := wpadHosts(tt.domains)
+		if strings.Join(got, " ") != tt.hosts {
+			t.Errorf("expecting %q for %q, got %q", tt.hosts, tt.domains, got)
+		}
+	}
+}
+
+func TestParseSearchDomains(t *testing.T) {
+	got := parseSearchDomains(strings.NewReader("nameserver 10.0.0.1\ndomain old.example.com\nsearch a.example.com b.example.com\n"))
+	if strings.Join(got, " ") != "a.example.com b.example.com" {
+		t.Errorf("unexpected search domains %q", got)
+	}
+}
+
+func TestWPADLoader(t *testing.T) {
+	var requested string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.Host + r.URL.Path
+		w.Write([]byte(DirectPAC))
+	}))
+	defer server.Close()
+
+	l := NewWPADLoader(
+		WPADSearchDomains(func() ([]string, error) {
+			return []string{"dept.office.example.com"}, nil
+		}),
+		WPADResolver(pacfunc.HostsResolver{
+			Hosts: map[string][]string{
+				"wpad.example.com": {"127.0.0.1"},
+			},
+		}),
+		WPADHTTPClient(&http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return net.Dial(network, server.Listener.Addr().String())
+				},
+			},
+		}),
+	)
+	pac, err := l.Load()
+	if err != nil || pac != DirectPAC {
+		t.Errorf("unexpected load %q, %v", pac, err)
+	}
+	if requested != "wpad.example.com/wpad.dat" {
+		t.Errorf("unexpected request for %q", requested)
+	}
+}
+
+func TestWPADLoaderNotFound(t *testing.T) {
+	l := NewWPADLoader(
+		WPADSearchDomains(func() ([]string, error) {
+			return []string{"office.example.com"}, nil
+		}),
+		WPADResolver(pacfunc.HostsResolver{}),
+	)
+	if _, err := l.Load(); err == nil {
+		t.Errorf("expecting an error")
+	}
+	l = NewWPADLoader(
+		WPADSearchDomains(func() ([]string, error) {
+			return nil, errors.New("no DNS search domains found")
+		}),
+	)
+	if _, err := l.Load(); err == nil || err.Error() != "no DNS search domains found" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestWPADLoaderVerify(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := "function FindProxyForURL(url, host){ return 'PROXY proxy.example.com:8080'; }"
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.Host+r.URL.Path)
+		switch r.Host + r.URL.Path {
+		case "wpad.office.example.com/wpad.dat":
+			w.Write([]byte(DirectPAC))
+		case "wpad.office.example.com/wpad.dat.sig":
+			w.Write(ed25519.Sign(private, []byte(signed)))
+		case "wpad.example.com/wpad.dat":
+			w.Write([]byte(signed))
+		case "wpad.example.com/wpad.dat.sig":
+			w.Write(ed25519.Sign(private, []byte(signed)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	l := NewWPADLoader(
+		WPADSearchDomains(func() ([]string, error) {
+			return []string{"office.example.com"}, nil
+		}),
+		WPADResolver(pacfunc.HostsResolver{
+			Hosts: map[string][]string{
+				"wpad.office.example.com": {"127.0.0.1"},
+				"wpad.example.com":        {"127.0.0.1"},
+			},
+		}),
+		WPADHTTPClient(&http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return net.Dial(network, server.Listener.Addr().String())
+				},
+			},
+		}),
+		WPADVerify(func(load Loader, u *url.URL, fetch func(u *url.URL) Loader) Loader {
+			sig := *u
+			sig.Path += ".sig"
+			return Ed25519Loader(load, fetch(&sig), public)
+		}),
+	)
+	pac, err := l.Load()
+	if err != nil || pac != signed {
+		t.Errorf("expecting the signed PAC, got %q, %v", pac, err)
+	}
+	e := "wpad.office.example.com/wpad.dat wpad.office.example.com/wpad.dat.sig wpad.example.com/wpad.dat wpad.example.com/wpad.dat.sig"
+	if strings.Join(requested, " ") != e {
+		t.Errorf("expecting requests for %q, got %q", e, requested)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/williambailey/pacproxy/pac"
+)
+
+// newPACFetchOpts configures how a PAC is fetched from a URL using the
+// -pac-fetch-* flags
+func newPACFetchOpts() ([]pac.HTTPSourceOpt, error) {
+	tlsConfig, err := newTLSConfig(fPacFetchCA, fPacFetchCert, fPacFetchKey, "")
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	switch fPacFetchProxy {
+	case "env":
+		transport.Proxy = http.ProxyFromEnvironment
+	case "direct":
+		transport.Proxy = nil
+	default:
+		u, err := url.Parse(fPacFetchProxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("Unexpected value %q for -pac-fetch-proxy", fPacFetchProxy)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   fPacFetchTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > fPacFetchRedirects {
+				return fmt.Errorf("stopped after %d redirects", fPacFetchRedirects)
+			}
+			return nil
+		},
+	}
+
+	opts := []pac.HTTPSourceOpt{pac.HTTPClient(client)}
+	for _, h := range fPacFetchHeader {
+		opts = append(opts, pac.HTTPHeader(h[0], h[1]))
+	}
+	if fPacFetchUser != "" && fPacFetchToken != "" {
+		return nil, errors.New("Only one of -pac-fetch-user and -pac-fetch-token can be used")
+	}
+	if fPacFetchUser != "" {
+		parts := strings.SplitN(fPacFetchUser, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Unexpected value for -pac-fetch-user, expecting user:password")
+		}
+		opts = append(opts, pac.HTTPBasicAuth(parts[0], parts[1]))
+	}
+	if fPacFetchToken != "" {
+		opts = append(opts, pac.HTTPBearerToken(fPacFetchToken))
+	}
+	return opts, nil
+}
+
+// pacVerifier wraps the loader for the PAC at u so that the PAC is refused
+// unless it passes the -pac-sha256 and -pac-pubkey checks. fetch loads other
+// URLs, such as the signature, in the same way as the PAC.
+type pacVerifier func(loader pac.Loader, u *url.URL, fetch func(u *url.URL) pac.Loader) pac.Loader
+
+// newPACVerifier for the -pac-sha256 and -pac-pubkey flags, nil when neither
+// is set
+func newPACVerifier() (pacVerifier, error) {
+	if len(fPacSHA256) == 0 && fPacPublicKey == "" {
+		return nil, nil
+	}
+	var key ed25519.PublicKey
+	if fPacPublicKey != "" {
+		s := fPacPublicKey
+		if buf, err := ioutil.ReadFile(s); err == nil {
+			s = string(buf)
+		}
+		var err error
+		if key, err = pac.ParseEd25519PublicKey(s); err != nil {
+			return nil, fmt.Errorf("Unexpected value for -pac-pubkey: %s", err)
+		}
+	}
+	return func(loader pac.Loader, u *url.URL, fetch func(u *url.URL) pac.Loader) pac.Loader {
+		if len(fPacSHA256) > 0 {
+			loader = pac.SHA256Loader(loader, fPacSHA256...)
+		}
+		if key != nil {
+			sigURL := *u
+			sigURL.Path += ".sig"
+			sigURL.RawPath = ""
+			loader = pac.Ed25519Loader(loader, fetch(&sigURL), key)
+		}
+		return loader
+	}, nil
+}
@@ -0,0 +1,139 @@
+package pacfunc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/williambailey/pacproxy/internal/lru"
+)
+
+// DNSCacheOpt used to configure a DNSCache via the NewDNSCache func
+type DNSCacheOpt func(*DNSCache)
+
+// DNSCacheSize sets the maximum number of lookups to keep
+func DNSCacheSize(n int) DNSCacheOpt {
+	return func(c *DNSCache) {
+		c.size = n
+	}
+}
+
+// DNSCacheTTL sets how long the addresses of a host are kept for
+func DNSCacheTTL(d time.Duration) DNSCacheOpt {
+	return func(c *DNSCache) {
+		c.ttl = d
+	}
+}
+
+// DNSCacheNegativeTTL sets how long it is kept that a host does not exist,
+// 0 to not keep it
+func DNSCacheNegativeTTL(d time.Duration) DNSCacheOpt {
+	return func(c *DNSCache) {
+		c.negativeTTL = d
+	}
+}
+
+// NewDNSCache instance with configuration, which fails when the size is
+// less than 1
+func NewDNSCache(resolver Resolver, opts ...DNSCacheOpt) (*DNSCache, error) {
+	c := &DNSCache{
+		resolver:    resolver,
+		size:        1000,
+		ttl:         time.Minute,
+		negativeTTL: 10 * time.Second,
+		now:         time.Now,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	var err error
+	if c.lru, err = lru.New(c.size); err != nil {
+		return nil, fmt.Errorf("DNS %s", err)
+	}
+	return c, nil
+}
+
+// DNSCache keeps the most recently used lookups from another Resolver, so
+// that a PAC which resolves the same host more than once for each request
+// only causes one lookup. Hosts that do not exist are kept too, but lookups
+// that fail for any other reason are not.
+type DNSCache struct {
+	mutex       sync.Mutex
+	resolver    Resolver
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+	lru         *lru.Cache
+	purges      int
+}
+
+// DNSCacheStats for a DNSCache
+type DNSCacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Size   int
+}
+
+type dnsCacheEntry struct {
+	addrs    []string
+	notFound bool
+}
+
+func (c *DNSCache) LookupHost(ctx context.Context, host string) ([]string, error) {
+	key := strings.TrimSuffix(strings.ToLower(host), ".")
+	now := c.now()
+	c.mutex.Lock()
+	if value, ok := c.lru.Get(key, now); ok {
+		c.mutex.Unlock()
+		entry := value.(*dnsCacheEntry)
+		if entry.notFound {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return append([]string{}, entry.addrs...), nil
+	}
+	purges := c.purges
+	c.mutex.Unlock()
+
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	entry := &dnsCacheEntry{
+		addrs: append([]string{}, addrs...),
+	}
+	expires := now.Add(c.ttl)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound || c.negativeTTL <= 0 {
+			return addrs, err
+		}
+		entry.notFound = true
+		expires = now.Add(c.negativeTTL)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if purges != c.purges {
+		// looked up before the cache was purged
+		return addrs, err
+	}
+	c.lru.Add(key, entry, expires)
+	return addrs, err
+}
+
+// Purge every cached lookup
+func (c *DNSCache) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lru.Purge()
+	c.purges++
+}
+
+// Stats returns the hit and miss counters along with the current size
+func (c *DNSCache) Stats() DNSCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return DNSCacheStats(c.lru.Stats())
+}
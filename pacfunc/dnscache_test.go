@@ -0,0 +1,150 @@
+package pacfunc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingResolver counts the lookups that it is asked to make
+type countingResolver struct {
+	lookups int
+	err     error
+}
+
+func (r *countingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.lookups++
+	if r.err != nil {
+		return nil, r.err
+	}
+	if strings.HasPrefix(host, "missing.") {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return []string{"192.0.2.1"}, nil
+}
+
+func mustDNSCache(t *testing.T, resolver Resolver, opts ...DNSCacheOpt) *DNSCache {
+	c, err := NewDNSCache(resolver, opts...)
+	if err != nil {
+		t.Fatalf("failed to create the cache: %q", err)
+	}
+	return c
+}
+
+func TestDNSCache(t *testing.T) {
+	r := &countingResolver{}
+	c := mustDNSCache(t, r)
+	d := DNS{Resolver: c}
+	for _, host := range []string{"a.example.com", "A.example.com.", "a.example.com"} {
+		if ip := d.DNSResolve(host); ip != "192.0.2.1" {
+			t.Errorf("expecting %q to resolve to 192.0.2.1, got %q", host, ip)
+		}
+	}
+	d.IsInNet("b.example.com", "192.0.2.0", "255.255.255.0")
+	d.IsResolvable("b.example.com")
+	if r.lookups != 2 {
+		t.Errorf("expecting 2 lookups, got %d", r.lookups)
+	}
+	if s := c.Stats(); s.Hits != 3 || s.Misses != 2 || s.Size != 2 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	r := &countingResolver{}
+	c := mustDNSCache(t, r, DNSCacheTTL(time.Minute), DNSCacheNegativeTTL(10*time.Second))
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	lookup := func(host string) {
+		c.LookupHost(context.Background(), host)
+	}
+	lookup("a.example.com")
+	lookup("missing.example.com")
+	now = now.Add(9 * time.Second)
+	lookup("a.example.com")
+	lookup("missing.example.com")
+	if r.lookups != 2 {
+		t.Errorf("expecting 2 lookups, got %d", r.lookups)
+	}
+	now = now.Add(time.Second)
+	lookup("missing.example.com")
+	if r.lookups != 3 {
+		t.Errorf("expecting the negative TTL to have expired")
+	}
+	now = now.Add(50 * time.Second)
+	lookup("a.example.com")
+	if r.lookups != 4 {
+		t.Errorf("expecting the TTL to have expired")
+	}
+}
+
+func TestDNSCacheNotFound(t *testing.T) {
+	r := &countingResolver{}
+	c := mustDNSCache(t, r)
+	for i := 0; i < 2; i++ {
+		_, err := c.LookupHost(context.Background(), "missing.example.com")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("expecting a not found error, got %v", err)
+		}
+	}
+	if r.lookups != 1 {
+		t.Errorf("expecting 1 lookup, got %d", r.lookups)
+	}
+	c = mustDNSCache(t, r, DNSCacheNegativeTTL(0))
+	c.LookupHost(context.Background(), "missing.example.com")
+	c.LookupHost(context.Background(), "missing.example.com")
+	if r.lookups != 3 {
+		t.Errorf("expecting a negative TTL of 0 to not cache")
+	}
+}
+
+func TestDNSCacheDoesNotCacheErrors(t *testing.T) {
+	r := &countingResolver{err: errors.New("i/o timeout")}
+	c := mustDNSCache(t, r)
+	c.LookupHost(context.Background(), "a.example.com")
+	c.LookupHost(context.Background(), "a.example.com")
+	if r.lookups != 2 {
+		t.Errorf("expecting 2 lookups, got %d", r.lookups)
+	}
+}
+
+func TestDNSCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	r := &countingResolver{}
+	c := mustDNSCache(t, r, DNSCacheSize(2))
+	for _, host := range []string{"a.example.com", "b.example.com", "a.example.com", "d.example.com", "a.example.com"} {
+		c.LookupHost(context.Background(), host)
+	}
+	if r.lookups != 3 {
+		t.Errorf("expecting 3 lookups, got %d", r.lookups)
+	}
+	c.LookupHost(context.Background(), "b.example.com")
+	if r.lookups != 4 {
+		t.Errorf("expecting \"b.example.com\" to have been evicted")
+	}
+}
+
+func TestDNSCachePurge(t *testing.T) {
+	r := &countingResolver{}
+	c := mustDNSCache(t, r)
+	c.LookupHost(context.Background(), "a.example.com")
+	c.Purge()
+	if s := c.Stats(); s.Size != 0 {
+		t.Errorf("expecting an empty cache, got %+v", s)
+	}
+	c.LookupHost(context.Background(), "a.example.com")
+	if r.lookups != 2 {
+		t.Errorf("expecting 2 lookups, got %d", r.lookups)
+	}
+}
+
+func TestDNSCacheSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		if _, err := NewDNSCache(&countingResolver{}, DNSCacheSize(size)); err == nil {
+			t.Errorf("expecting an error for a cache size of %d", size)
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package pacfunc
 
 import (
+	"bytes"
 	"encoding/binary"
 	"net"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -14,6 +16,9 @@ var (
 	// DefaultNower thats used by these functions to get the currant time
 	DefaultNower Nower
 
+	// DefaultResolver thats used by these functions to resolve hosts
+	DefaultResolver Resolver
+
 	weekday = map[string]time.Weekday{
 		"SUN": time.Sunday,
 		"MON": time.Monday,
@@ -41,6 +46,7 @@ var (
 
 func init() {
 	DefaultNower = &TimeNower{}
+	DefaultResolver = net.DefaultResolver
 }
 
 // Nower is responsible for returning the current time
@@ -65,15 +71,47 @@ type StaticNower struct {
 	now time.Time
 }
 
+// NewStaticNower returns a StaticNower that is always now
+func NewStaticNower(now time.Time) StaticNower {
+	return StaticNower{now: now}
+}
+
 func (s StaticNower) Now() time.Time {
 	return s.now
 }
 
-// ConvertAddr converts an IPv4 dotted decimal IP address or an IPv6 IP address to an integer
+// Clock implements the date and time functions using Nower, or DefaultNower
+// when it is not set, so that each engine can have its own. Times that are
+// not GMT are taken to be in Location when it is set, otherwise in the
+// location of the time that Nower returns.
+type Clock struct {
+	Nower    Nower
+	Location *time.Location
+}
+
+// now returns the current time, in GMT when gmt is true
+func (c Clock) now(gmt bool) time.Time {
+	nower := c.Nower
+	if nower == nil {
+		nower = DefaultNower
+	}
+	now := nower.Now()
+	if gmt {
+		return now.UTC()
+	}
+	if c.Location != nil {
+		return now.In(c.Location)
+	}
+	return now
+}
+
+// ConvertAddr converts an IPv4 dotted decimal IP address, or an IPv4-mapped
+// IPv6 address, to an integer. Anything else, including other IPv6
+// addresses which do not fit, converts to 0.
 func ConvertAddr(ipaddr string) uint32 {
-	ip := net.ParseIP(ipaddr)
-	if len(ip) == 16 {
-		return binary.BigEndian.Uint32(ip[12:16])
+	ip := net.ParseIP(ipaddr).To4()
+	if ip == nil {
+		return 0
 	}
 	return binary.BigEndian.Uint32(ip)
 }
@@ -99,38 +137,122 @@ func ShExpMatch(str, shexp string) bool {
 
 // IsInNet evaluates the IP address of a hostname, and if within a specified
 // subnet returns true. If a hostname is passed the function will resolve the
-// hostname to an IP address.
+// hostname to an IP address of the same family as netip.
+//
+// For IPv4 netmask is dotted decimal, e.g. "255.240.0.0". For IPv6 netmask
+// may be an IPv6 mask, e.g. "ffff:ffff::", or a prefix length, e.g. "32" or
+// "/32", and netip may instead be given in CIDR notation with netmask left
+// empty.
 func IsInNet(host, netip, netmask string) bool {
+	return DNS{}.IsInNet(host, netip, netmask)
+}
+
+// IsInNet is IsInNet using d's resolver
+func (d DNS) IsInNet(host, netip, netmask string) bool {
 	if len(host) == 0 {
 		return false
 	}
-	address, err := net.ResolveIPAddr("ip", host)
-	if err != nil {
+	network := parseNet(netip, netmask)
+	if network == nil {
 		return false
 	}
-	net := net.IPNet{
-		IP:   net.ParseIP(netip),
-		Mask: net.IPMask(net.ParseIP(netmask)),
+	ip := d.resolveIP(host, len(network.IP) == net.IPv4len)
+	if ip == nil {
+		return false
 	}
-	return net.Contains(address.IP)
+	return network.Contains(ip)
+}
+
+// parseNet returns the network for netip and netmask, or nil if either are
+// bad
+func parseNet(netip, netmask string) *net.IPNet {
+	netmask = strings.TrimSpace(netmask)
+	if strings.Contains(netip, "/") {
+		if netmask != "" {
+			return nil
+		}
+		_, network, err := net.ParseCIDR(netip)
+		if err != nil {
+			return nil
+		}
+		return network
+	}
+	ip := net.ParseIP(netip)
+	if ip == nil {
+		return nil
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 8 * net.IPv4len
+	}
+	var mask net.IPMask
+	if m := net.ParseIP(netmask); m != nil {
+		if len(ip) == net.IPv4len {
+			m = m.To4()
+		} else if m.To4() != nil {
+			m = nil
+		}
+		mask = net.IPMask(m)
+	} else if n, err := strconv.Atoi(strings.TrimPrefix(netmask, "/")); err == nil && n >= 0 && n <= bits {
+		mask = net.CIDRMask(n, bits)
+	}
+	if len(mask) != len(ip) {
+		return nil
+	}
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// resolveIP returns the first IPv4 address of host when preferIPv4,
+// otherwise the first IPv6 one, or nil if it has none
+func (d DNS) resolveIP(host string, preferIPv4 bool) net.IP {
+	ips, err := d.lookupIP(host)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && preferIPv4 {
+			return ip4
+		} else if ip4 == nil && !preferIPv4 {
+			return ip
+		}
+	}
+	return nil
 }
 
 // MyIPAddress returns the IP address of the host machine.
 func MyIPAddress() string {
+	return DNS{}.MyIPAddress()
+}
+
+// MyIPAddress is MyIPAddress using d's resolver
+func (d DNS) MyIPAddress() string {
 	hostname, err := os.Hostname()
 	if err != nil {
 		return "127.0.0.1"
 	}
-	return DNSResolve(hostname)
+	return d.DNSResolve(hostname)
 }
 
-// DNSResolve returns the IP address of the host.
+// DNSResolve returns the IP address of the host, its first IPv4 address if
+// it has one, otherwise its first IPv6 address.
 func DNSResolve(host string) string {
-	address, err := net.ResolveIPAddr("ip", host)
-	if err != nil {
+	return DNS{}.DNSResolve(host)
+}
+
+// DNSResolve is DNSResolve using d's resolver
+func (d DNS) DNSResolve(host string) string {
+	if len(host) == 0 {
+		return ""
+	}
+	ip := d.resolveIP(host, true)
+	if ip == nil {
+		ip = d.resolveIP(host, false)
+	}
+	if ip == nil {
 		return ""
 	}
-	return address.String()
+	return ip.String()
 }
 
 // IsPlainHostName will return true if the hostname contains no dots, e.g. http://intranet
@@ -153,10 +275,15 @@ func LocalHostOrDomainIs(host, hostdom string) bool {
 // IsResolvable attempts to resolve a hostname to an IP address and returns
 // true if successful.
 func IsResolvable(host string) bool {
+	return DNS{}.IsResolvable(host)
+}
+
+// IsResolvable is IsResolvable using d's resolver
+func (d DNS) IsResolvable(host string) bool {
 	if len(host) == 0 {
 		return false
 	}
-	if _, err := net.ResolveIPAddr("ip", host); err != nil {
+	if _, err := d.lookupIP(host); err != nil {
 		return false
 	}
 	return true
@@ -169,6 +296,116 @@ func DNSDomainLevels(host string) int {
 	return strings.Count(host, ".")
 }
 
+// IsInNetEx is the IPv6 aware version of IsInNet from Microsoft's PAC
+// extensions. It returns true if the IP address ipaddr is within ipprefix,
+// given in CIDR notation, e.g. "198.95.0.0/16" or "3ffe:8311:ffff::/48".
+func IsInNetEx(ipaddr, ipprefix string) bool {
+	ip := net.ParseIP(ipaddr)
+	if ip == nil {
+		return false
+	}
+	_, network, err := net.ParseCIDR(ipprefix)
+	if err != nil {
+		return false
+	}
+	return network.Contains(ip)
+}
+
+// MyIPAddressEx returns a semicolon separated list of the IPv4 and IPv6
+// addresses of the host machine, or "" if it has none.
+func MyIPAddressEx() string {
+	return DNS{}.MyIPAddressEx()
+}
+
+// MyIPAddressEx is MyIPAddressEx using d's resolver. Like MyIPAddress it
+// resolves the hostname, falling back to the addresses of the network
+// interfaces when the hostname does not resolve.
+func (d DNS) MyIPAddressEx() string {
+	if hostname, err := os.Hostname(); err == nil {
+		if ips := d.DNSResolveEx(hostname); ips != "" {
+			return ips
+		}
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	var ips []string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, ipnet.IP.String())
+	}
+	return strings.Join(ips, ";")
+}
+
+// DNSResolveEx returns a semicolon separated list of the IPv4 and IPv6
+// addresses of the host, or "" if it can not be resolved.
+func DNSResolveEx(host string) string {
+	return DNS{}.DNSResolveEx(host)
+}
+
+// DNSResolveEx is DNSResolveEx using d's resolver
+func (d DNS) DNSResolveEx(host string) string {
+	if len(host) == 0 {
+		return ""
+	}
+	ips, err := d.lookupIP(host)
+	if err != nil {
+		return ""
+	}
+	list := make([]string, len(ips))
+	for i, ip := range ips {
+		list[i] = ip.String()
+	}
+	return strings.Join(list, ";")
+}
+
+// IsResolvableEx returns true if the host resolves to at least one IPv4 or
+// IPv6 address.
+func IsResolvableEx(host string) bool {
+	return DNS{}.IsResolvableEx(host)
+}
+
+// IsResolvableEx is IsResolvableEx using d's resolver
+func (d DNS) IsResolvableEx(host string) bool {
+	return d.DNSResolveEx(host) != ""
+}
+
+// SortIPAddressList sorts a semicolon separated list of IPv4 and IPv6
+// addresses, IPv6 addresses first. It returns false if the list is empty or
+// anything in it is not an IP address.
+func SortIPAddressList(list string) (string, bool) {
+	var ips []net.IP
+	for _, s := range strings.Split(list, ";") {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil {
+			return "", false
+		}
+		ips = append(ips, ip)
+	}
+	sort.SliceStable(ips, func(i, j int) bool {
+		i4, j4 := ips[i].To4() != nil, ips[j].To4() != nil
+		if i4 != j4 {
+			return j4
+		}
+		return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0
+	})
+	sorted := make([]string, len(ips))
+	for i, ip := range ips {
+		sorted[i] = ip.String()
+	}
+	return strings.Join(sorted, ";"), true
+}
+
+// GetClientVersion returns the version of Microsoft's PAC extensions that
+// are implemented.
+func GetClientVersion() string {
+	return "1.0"
+}
+
 // WeekdayRange return true if the current date is during that period
 //
 // Only the first parameter is mandatory. Either the second, the third, or
@@ -184,6 +421,11 @@ func DNSDomainLevels(host string) int {
 // but the bounds are ordered. If the "GMT" parameter is specified, times
 // are taken to be in GMT. Otherwise, the local timezone is used.
 func WeekdayRange(wd1, wd2, gmt string) bool {
+	return Clock{}.WeekdayRange(wd1, wd2, gmt)
+}
+
+// WeekdayRange is WeekdayRange using c's clock
+func (c Clock) WeekdayRange(wd1, wd2, gmt string) bool {
 	wd1 = strings.ToUpper(wd1)
 	wd2 = strings.ToUpper(wd2)
 	gmt = strings.ToUpper(gmt)
@@ -194,10 +436,7 @@ func WeekdayRange(wd1, wd2, gmt string) bool {
 	if wd2 == "" {
 		wd2 = wd1
 	}
-	now := DefaultNower.Now()
-	if gmt == "GMT" {
-		now = now.UTC()
-	}
+	now := c.now(gmt == "GMT")
 	today := now.Weekday()
 	var (
 		ok       = true
@@ -223,6 +462,11 @@ func WeekdayRange(wd1, wd2, gmt string) bool {
 //
 // (<day1>, <month1>, <year1>, <day2>, <month2>, <year2>, <gmt>)
 func DateRange(args []string) bool {
+	return Clock{}.DateRange(args)
+}
+
+// DateRange is DateRange using c's clock
+func (c Clock) DateRange(args []string) bool {
 	getMonth := func(name string) time.Month {
 		month, _ := month[name]
 		return month
@@ -234,12 +478,11 @@ func DateRange(args []string) bool {
 	for k, v := range args {
 		args[k] = strings.ToUpper(v)
 	}
-	now := DefaultNower.Now()
 	isGMT := args[argc-1] == "GMT"
 	if isGMT {
 		argc--
-		now = now.UTC()
 	}
+	now := c.now(isGMT)
 	if argc == 1 {
 		tmp, err := strconv.Atoi(args[0])
 		if err != nil {
@@ -349,6 +592,11 @@ func DateRange(args []string) bool {
 //
 // (<hour1>, <min1>, <sec1>, <hour2>, <min2>, <sec2>, <gmt>)
 func TimeRange(args []string) bool {
+	return Clock{}.TimeRange(args)
+}
+
+// TimeRange is TimeRange using c's clock
+func (c Clock) TimeRange(args []string) bool {
 	argc := len(args)
 	if argc < 1 {
 		return false
@@ -356,12 +604,11 @@ func TimeRange(args []string) bool {
 	for k, v := range args {
 		args[k] = strings.ToUpper(v)
 	}
-	now := DefaultNower.Now()
 	isGMT := args[argc-1] == "GMT"
 	if isGMT {
 		argc--
-		now = now.UTC()
 	}
+	now := c.now(isGMT)
 	date1 := now
 	date2 := now
 	switch argc {
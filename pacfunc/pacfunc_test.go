@@ -1,6 +1,8 @@
 package pacfunc
 
 import (
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -14,8 +16,19 @@ func TestConvertAddr(t *testing.T) {
 	}
 	assertTrue("127.0.0.1", 2130706433)
 	assertTrue("10.56.23.193", 171448257)
-	assertTrue("0:0:0:0:0:0:7f00:1", 2130706433)
-	assertTrue("2000:4A2B::1f3F", 7999)
+	assertTrue("::ffff:127.0.0.1", 2130706433)
+	assertTrue("0:0:0:0:0:0:7f00:1", 0)
+	assertTrue("2000:4A2B::1f3F", 0)
+	assertTrue("not an ip", 0)
+}
+
+// dualStackDNS resolves dualStackHosts without using the machine's DNS
+var dualStackDNS = DNS{Resolver: HostsResolver{Hosts: dualStackHosts}}
+
+var dualStackHosts = map[string][]string{
+	"dual.example.com": {"2001:db8::1", "192.0.2.1", "192.0.2.2"},
+	"v4.example.com":   {"192.0.2.3"},
+	"v6.example.com":   {"2001:db8::2", "2001:db8::3"},
 }
 
 func TestDNSDomainIs(t *testing.T) {
@@ -66,6 +79,35 @@ func TestIsInNet(t *testing.T) {
 	assertTrue("192.168.1.30", "192.168.1.24", "255.255.255.248")
 	assertTrue("192.168.1.31", "192.168.1.24", "255.255.255.248")
 	assertFalse("192.168.1.32", "192.168.1.24", "255.255.255.248")
+	assertTrue("::ffff:192.168.1.25", "192.168.1.24", "255.255.255.248")
+	assertTrue("10.1.2.3", "10.0.2.0", "255.0.255.0")
+	assertFalse("10.1.2.3", "10.0.0.0", "not a mask")
+	assertFalse("10.1.2.3", "10.0.0.0", "ffff::")
+	assertFalse("10.1.2.3", "not an ip", "255.0.0.0")
+	assertTrue("2001:db8:1::1", "2001:db8::", "32")
+	assertTrue("2001:db8:1::1", "2001:db8::", "/32")
+	assertTrue("2001:db8:1::1", "2001:db8::", "ffff:ffff::")
+	assertTrue("2001:db8:1::1", "2001:db8::/32", "")
+	assertFalse("2001:db9::1", "2001:db8::/32", "")
+	assertFalse("2001:db8:1::1", "2001:db8::/32", "255.0.0.0")
+	assertFalse("2001:db8:1::1", "2001:db8::", "255.0.0.0")
+	assertFalse("2001:db8:1::1", "2001:db8::", "129")
+	assertFalse("10.1.2.3", "2001:db8::", "32")
+	assertFalse("2001:db8::1", "10.0.0.0", "255.0.0.0")
+}
+
+func TestIsInNetDualStack(t *testing.T) {
+	assertIsInNet := func(h, i, m string, e bool) {
+		if dualStackDNS.IsInNet(h, i, m) != e {
+			t.Errorf("expecting %q in the network %q with the mask %q to be %t", h, i, m, e)
+		}
+	}
+	assertIsInNet("dual.example.com", "192.0.2.0", "255.255.255.0", true)
+	assertIsInNet("dual.example.com", "2001:db8::", "32", true)
+	assertIsInNet("v4.example.com", "192.0.2.0", "255.255.255.0", true)
+	assertIsInNet("v4.example.com", "2001:db8::", "32", false)
+	assertIsInNet("v6.example.com", "192.0.2.0", "255.255.255.0", false)
+	assertIsInNet("v6.example.com", "2001:db8::", "32", true)
 }
 
 func TestMyIPAddress(t *testing.T) {
@@ -83,6 +125,22 @@ func TestDNSResolve(t *testing.T) {
 	}
 }
 
+func TestDNSResolveDualStack(t *testing.T) {
+	assertResolve := func(h, e string) {
+		if ip := dualStackDNS.DNSResolve(h); ip != e {
+			t.Errorf("Expecting %q to resolve to %q, got %q", h, e, ip)
+		}
+	}
+	assertResolve("dual.example.com", "192.0.2.1")
+	assertResolve("v4.example.com", "192.0.2.3")
+	assertResolve("v6.example.com", "2001:db8::2")
+	assertResolve("::ffff:192.0.2.4", "192.0.2.4")
+	assertResolve("", "")
+	if ips := dualStackDNS.DNSResolveEx("dual.example.com"); ips != "2001:db8::1;192.0.2.1;192.0.2.2" {
+		t.Errorf("Expecting dual.example.com to resolve to all of its addresses, got %q", ips)
+	}
+}
+
 func TestIsPlainHostName(t *testing.T) {
 	if !IsPlainHostName("internet") {
 		t.Error("Expecting \"internet\" to be classes as a plan hostname")
@@ -139,6 +197,84 @@ func TestDNSDomainLevels(t *testing.T) {
 	assertLevels("a.b.c.d.example.org", 5)
 }
 
+func TestIsInNetEx(t *testing.T) {
+	assertTrue := func(i, p string) {
+		if !IsInNetEx(i, p) {
+			t.Errorf("%q should fall within %q", i, p)
+		}
+	}
+	assertFalse := func(i, p string) {
+		if IsInNetEx(i, p) {
+			t.Errorf("%q should not fall within %q", i, p)
+		}
+	}
+	assertTrue("198.95.249.79", "198.95.0.0/16")
+	assertFalse("198.96.249.79", "198.95.0.0/16")
+	assertTrue("3ffe:8311:ffff:abcd::1", "3ffe:8311:ffff::/48")
+	assertFalse("3ffe:8311:fffe::1", "3ffe:8311:ffff::/48")
+	assertFalse("198.95.249.79", "3ffe:8311:ffff::/48")
+	assertFalse("localhost", "127.0.0.0/8")
+	assertFalse("198.95.249.79", "198.95.0.0")
+	assertFalse("", "198.95.0.0/16")
+}
+
+func TestMyIPAddressEx(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+	d := DNS{Resolver: HostsResolver{Hosts: map[string][]string{
+		strings.ToLower(hostname): {"192.0.2.1", "2001:db8::1"},
+	}}}
+	if ips := d.MyIPAddressEx(); ips != "192.0.2.1;2001:db8::1" {
+		t.Errorf("Expecting the hostname to resolve to %q, got %q", "192.0.2.1;2001:db8::1", ips)
+	}
+	// an unresolvable hostname falls back to the network interfaces
+	d = DNS{Resolver: HostsResolver{}}
+	for _, ip := range strings.Split(d.MyIPAddressEx(), ";") {
+		if ip == "127.0.0.1" || ip == "::1" {
+			t.Errorf("Expecting no loopback addresses, got %q", ip)
+		}
+	}
+}
+
+func TestDNSResolveEx(t *testing.T) {
+	if ips := dualStackDNS.DNSResolveEx("v6.example.com"); ips != "2001:db8::2;2001:db8::3" {
+		t.Errorf("Expecting v6.example.com to resolve to 2001:db8::2;2001:db8::3, got %q", ips)
+	}
+	if ip := dualStackDNS.DNSResolveEx("unresolvable.example.com"); ip != "" {
+		t.Errorf("Expecting unresolvable.example.com not resolve, got %q", ip)
+	}
+}
+
+func TestIsResolvableEx(t *testing.T) {
+	if !dualStackDNS.IsResolvableEx("v6.example.com") {
+		t.Error("expecting \"v6.example.com\" to be true")
+	}
+	if dualStackDNS.IsResolvableEx("unresolvable.example.com") || dualStackDNS.IsResolvableEx("") {
+		t.Error("expecting \"unresolvable.example.com\" and \"\" to be false")
+	}
+}
+
+func TestSortIPAddressList(t *testing.T) {
+	assertSort := func(l, e string, ok bool) {
+		s, sok := SortIPAddressList(l)
+		if s != e || sok != ok {
+			t.Errorf("expecting %q to sort to %q, %t, got %q, %t", l, e, ok, s, sok)
+		}
+	}
+	assertSort("10.2.3.9;2001:4898:28:3:201:2ff:feea:fc14;::1;127.0.0.1;::9", "::1;::9;2001:4898:28:3:201:2ff:feea:fc14;10.2.3.9;127.0.0.1", true)
+	assertSort("10.2.3.9", "10.2.3.9", true)
+	assertSort("10.2.3.9;localhost", "", false)
+	assertSort("", "", false)
+}
+
+func TestGetClientVersion(t *testing.T) {
+	if v := GetClientVersion(); v != "1.0" {
+		t.Errorf("expecting version 1.0, got %q", v)
+	}
+}
+
 var (
 	ny, _        = time.LoadLocation("America/New_York")
 	sundayUTC    = time.Date(2017, 12, 31, 0, 0, 0, 0, time.UTC)
@@ -385,3 +521,26 @@ func TestTimeRange(t *testing.T) {
 		}
 	}
 }
+
+func TestClockLocation(t *testing.T) {
+	c := Clock{Nower: NewStaticNower(mondayUTC), Location: ny}
+	if !c.WeekdayRange("SUN", "", "") || !c.WeekdayRange("MON", "GMT", "") {
+		t.Error("expecting it to be Sunday in New York and Monday in GMT")
+	}
+	if !c.DateRange([]string{"31", "DEC", "2017"}) || !c.DateRange([]string{"1", "JAN", "2018", "GMT"}) {
+		t.Error("expecting it to be 31 DEC 2017 in New York and 1 JAN 2018 in GMT")
+	}
+	if !c.TimeRange([]string{"19"}) || !c.TimeRange([]string{"0", "GMT"}) {
+		t.Error("expecting it to be 19:00 in New York and 00:00 in GMT")
+	}
+}
+
+func TestClockDefaultNower(t *testing.T) {
+	defer func() {
+		DefaultNower = &TimeNower{}
+	}()
+	DefaultNower = NewStaticNower(mondayUTC)
+	if !WeekdayRange("MON", "", "") || !(Clock{}).WeekdayRange("MON", "", "") {
+		t.Error("expecting DefaultNower to be used when a Clock has no Nower")
+	}
+}
@@ -0,0 +1,99 @@
+package pacfunc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Resolver looks up the addresses of a host, as net.Resolver does
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// TimeoutResolver limits each lookup made using Resolver to Timeout
+type TimeoutResolver struct {
+	Resolver Resolver
+	Timeout  time.Duration
+}
+
+func (t TimeoutResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if t.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+	return t.Resolver.LookupHost(ctx, host)
+}
+
+// HostsResolver answers lookups for the hosts in Hosts, keyed by lower case
+// host name, and passes any others on to Resolver if it is set.
+type HostsResolver struct {
+	Hosts    map[string][]string
+	Resolver Resolver
+}
+
+func (h HostsResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := h.Hosts[strings.TrimSuffix(strings.ToLower(host), ".")]; ok {
+		return append([]string{}, addrs...), nil
+	}
+	if h.Resolver == nil {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return h.Resolver.LookupHost(ctx, host)
+}
+
+// NewServerResolver returns a Resolver that queries the DNS servers, given
+// as host or host:port, instead of those the system is configured with.
+// Each attempt at a query goes to the next server in turn.
+func NewServerResolver(servers ...string) Resolver {
+	addrs := make([]string, len(servers))
+	for i, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		addrs[i] = server
+	}
+	var next uint32
+	dialer := &net.Dialer{}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			i := atomic.AddUint32(&next, 1) - 1
+			return dialer.DialContext(ctx, network, addrs[int(i)%len(addrs)])
+		},
+	}
+}
+
+// DNS implements the functions that resolve hosts using Resolver, or
+// DefaultResolver when it is not set, so that each engine can have its own.
+type DNS struct {
+	Resolver Resolver
+}
+
+// lookupIP returns the addresses of host, which may be an IP address
+func (d DNS) lookupIP(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = DefaultResolver
+	}
+	addrs, err := resolver.LookupHost(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
@@ -0,0 +1,125 @@
+package pacfunc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowResolver blocks each lookup until its context is done
+type slowResolver struct{}
+
+func (slowResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestTimeoutResolver(t *testing.T) {
+	d := DNS{Resolver: TimeoutResolver{Resolver: slowResolver{}, Timeout: 20 * time.Millisecond}}
+	start := time.Now()
+	if d.IsResolvable("slow.example.com") {
+		t.Error("expecting \"slow.example.com\" to be false")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expecting the lookup to time out, took %s", elapsed)
+	}
+}
+
+func TestHostsResolver(t *testing.T) {
+	r := HostsResolver{
+		Hosts: map[string][]string{
+			"static.example.com": {"192.0.2.1", "2001:db8::1"},
+		},
+	}
+	addrs, err := r.LookupHost(context.Background(), "Static.Example.com.")
+	if err != nil || strings.Join(addrs, ";") != "192.0.2.1;2001:db8::1" {
+		t.Errorf("unexpected lookup %q, %v", addrs, err)
+	}
+	var dnsErr *net.DNSError
+	if _, err := r.LookupHost(context.Background(), "other.example.com"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("expecting a not found error, got %v", err)
+	}
+	r.Resolver = HostsResolver{
+		Hosts: map[string][]string{
+			"other.example.com": {"192.0.2.2"},
+		},
+	}
+	d := DNS{Resolver: r}
+	if ip := d.DNSResolve("other.example.com"); ip != "192.0.2.2" {
+		t.Errorf("expecting lookups to be passed on, got %q", ip)
+	}
+	if ip := d.DNSResolve("static.example.com"); ip != "192.0.2.1" {
+		t.Errorf("expecting \"static.example.com\" to resolve to 192.0.2.1, got %q", ip)
+	}
+}
+
+func TestServerResolver(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	queried := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := buf[:n]
+			queried <- parseQueryName(query)
+			// answer every A query for the name with 192.0.2.53, and
+			// anything else with no answers, dropping any additional
+			// records such as EDNS0's
+			end := questionEnd(query)
+			answer := append([]byte{}, query[:end]...)
+			answer[2] |= 0x80
+			answer[10], answer[11] = 0, 0
+			if query[end-3] == 1 {
+				answer[7] = 1
+				answer = append(answer,
+					0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 192, 0, 2, 53,
+				)
+			}
+			conn.WriteTo(answer, addr)
+		}
+	}()
+
+	d := DNS{Resolver: TimeoutResolver{
+		Resolver: NewServerResolver(conn.LocalAddr().String()),
+		Timeout:  time.Second,
+	}}
+	if ip := d.DNSResolve("resolved.example.com"); ip != "192.0.2.53" {
+		t.Errorf("expecting resolved.example.com to resolve to 192.0.2.53, got %q", ip)
+	}
+	select {
+	case name := <-queried:
+		if name != "resolved.example.com." {
+			t.Errorf("unexpected query for %q", name)
+		}
+	default:
+		t.Error("expecting the server to be queried")
+	}
+}
+
+// parseQueryName returns the name asked about by a DNS query
+func parseQueryName(query []byte) string {
+	var labels []string
+	for i := 12; i < len(query) && query[i] != 0; i += int(query[i]) + 1 {
+		labels = append(labels, string(query[i+1:i+1+int(query[i])]))
+	}
+	return strings.Join(labels, ".") + "."
+}
+
+// questionEnd returns the offset just after the question of a DNS query
+func questionEnd(query []byte) int {
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		i += int(query[i]) + 1
+	}
+	return i + 5
+}
@@ -6,11 +6,13 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/williambailey/pacproxy/pac"
+	"github.com/williambailey/pacproxy/pacfunc"
 )
 
 // Name of the app
@@ -26,15 +28,113 @@ const About = "A no-frills local HTTP proxy server powered by a proxy auto-confi
 const Repo = "https://github.com/williambailey/pacproxy"
 
 var (
-	fPac     string
-	fListen  string
-	fVerbose bool
+	fPac               stringsFlag
+	fListen            string
+	fVerbose           bool
+	fEngine            string
+	fPool              int
+	fWatch             bool
+	fWatchPoll         time.Duration
+	fRefresh           time.Duration
+	fRefreshMin        time.Duration
+	fLastGood          string
+	fPacFetchCA        string
+	fPacFetchCert      string
+	fPacFetchKey       string
+	fPacFetchHeader    headerFlag
+	fPacFetchUser      string
+	fPacFetchToken     string
+	fPacFetchTimeout   time.Duration
+	fPacFetchRedirects int
+	fPacFetchProxy     string
+	fPacSHA256         stringsFlag
+	fPacPublicKey      string
+	fPacTimeout        time.Duration
+	fPacStart          time.Duration
+	fPacFallback       string
+	fNow               string
+	fTZ                string
+	fCache             int
+	fCacheTTL          time.Duration
+	fCacheKey          string
+	fDNSServer         stringsFlag
+	fDNSTimeout        time.Duration
+	fDNSHost           = make(hostsFlag)
+	fDNSCache          int
+	fDNSCacheTTL       time.Duration
+	fDNSCacheNegTTL    time.Duration
+	fUpstreamCA        string
+	fUpstreamCert      string
+	fUpstreamKey       string
+	fUpstreamSNI       string
+	fRetry             time.Duration
+	fRetryMax          time.Duration
+	fProbe             time.Duration
+	fProbeTimeout      time.Duration
+	fProbeCanary       string
+	fProbeExpiry       time.Duration
+	fProbeProxy        = make(probeProxyFlag)
+	fSelector          string
+	fWeight            = make(weightFlag)
+	fAlpha             float64
+	fExplore           float64
+	fRace              int
+	fRaceDelay         time.Duration
 )
 
 func init() {
-	flag.StringVar(&fPac, "c", "", "PAC file name, url or javascript to use (required)")
+	flag.Var(&fPac, "c", "PAC file name, url, javascript or \"wpad\" to discover it using DNS (the default), may be repeated to fall back to each in order")
 	flag.StringVar(&fListen, "l", "127.0.0.1:8080", "Interface and port to listen on")
 	flag.BoolVar(&fVerbose, "v", false, "send verbose output to STDERR")
+	flag.StringVar(&fEngine, "engine", "otto", "javascript engine used to run the PAC: otto or goja (ES2015+)")
+	flag.BoolVar(&fWatch, "watch", false, "reload the PAC whenever a file given by -c changes")
+	flag.DurationVar(&fWatchPoll, "watch-poll", 2*time.Second, "how often to check the file for -watch when it can not be watched using inotify")
+	flag.DurationVar(&fRefresh, "refresh", time.Hour, "how often to refresh a PAC loaded from a URL when the server does not say how long it is fresh for, 0 to disable")
+	flag.DurationVar(&fRefreshMin, "refresh-min", time.Minute, "shortest time between refreshes of a PAC loaded from a URL")
+	flag.StringVar(&fLastGood, "last-good", "", "file to keep the last PAC that the engine accepted in, and to use when the PAC can not be loaded")
+	flag.StringVar(&fPacFetchCA, "pac-fetch-ca", "", "PEM CA bundle used to verify the server when fetching the PAC from an https URL instead of the system roots")
+	flag.StringVar(&fPacFetchCert, "pac-fetch-cert", "", "PEM client certificate to present when fetching the PAC from an https URL")
+	flag.StringVar(&fPacFetchKey, "pac-fetch-key", "", "PEM private key for -pac-fetch-cert")
+	flag.Var(&fPacFetchHeader, "pac-fetch-header", "extra header to send when fetching the PAC from a URL as \"Name: value\", may be repeated")
+	flag.StringVar(&fPacFetchUser, "pac-fetch-user", "", "user:password for basic auth when fetching the PAC from a URL")
+	flag.StringVar(&fPacFetchToken, "pac-fetch-token", "", "bearer token to send when fetching the PAC from a URL")
+	flag.DurationVar(&fPacFetchTimeout, "pac-fetch-timeout", 30*time.Second, "timeout for fetching the PAC from a URL, 0 for no limit")
+	flag.IntVar(&fPacFetchRedirects, "pac-fetch-redirects", 10, "number of redirects to follow when fetching the PAC from a URL")
+	flag.StringVar(&fPacFetchProxy, "pac-fetch-proxy", "env", "proxy used to fetch the PAC from a URL: env to use HTTP_PROXY and friends, direct, or a proxy URL")
+	flag.Var(&fPacSHA256, "pac-sha256", "SHA-256, in hex, that a PAC fetched from a URL or found by wpad must have to be used, may be repeated")
+	flag.StringVar(&fPacPublicKey, "pac-pubkey", "", "Ed25519 public key, or a file containing one, that must have signed a PAC fetched from a URL or found by wpad for it to be used, the detached signature is fetched from the PAC URL with .sig appended")
+	flag.DurationVar(&fPacTimeout, "pac-timeout", 5*time.Second, "how long each FindProxyForURL call may take before it is interrupted, 0 for no limit")
+	flag.DurationVar(&fPacStart, "pac-start-timeout", 30*time.Second, "how long running the PAC when it is loaded may take before it is interrupted, 0 for no limit")
+	flag.StringVar(&fPacFallback, "pac-fallback", "", "PAC result to use when FindProxyForURL is interrupted, such as \"DIRECT\" or \"PROXY host:port\"")
+	flag.StringVar(&fNow, "now", "", "RFC 3339 time, such as 2006-01-02T15:04:05Z, for the PAC date and time functions to use instead of the current time, to simulate the PAC at that time")
+	flag.StringVar(&fTZ, "tz", "", "time zone, such as Europe/London, for the PAC date and time functions to use when they are not asked for GMT, instead of the local one")
+	flag.IntVar(&fCache, "cache", 0, "number of PAC results to cache, 0 to disable")
+	flag.DurationVar(&fCacheTTL, "cache-ttl", time.Minute, "how long a PAC result is cached for")
+	flag.StringVar(&fCacheKey, "cache-key", "host", "what PAC results are cached by: host, or url if the PAC looks at the path or query")
+	flag.Var(&fDNSServer, "dns-server", "DNS server, as host or host:port, for the PAC DNS functions and WPAD to use instead of the system ones, may be repeated")
+	flag.DurationVar(&fDNSTimeout, "dns-timeout", 2*time.Second, "how long each DNS lookup made by the PAC DNS functions and WPAD may take, 0 for no limit")
+	flag.Var(fDNSHost, "dns-host", "static address for a host, as host=ip[,ip...], for the PAC DNS functions and WPAD to use, may be repeated")
+	flag.IntVar(&fDNSCache, "dns-cache", 0, "number of DNS lookups made by the PAC DNS functions to cache, 0 to disable, the cache is purged when the PAC is reloaded")
+	flag.DurationVar(&fDNSCacheTTL, "dns-cache-ttl", time.Minute, "how long the addresses of a host are cached for")
+	flag.DurationVar(&fDNSCacheNegTTL, "dns-cache-negative-ttl", 10*time.Second, "how long it is cached that a host does not exist, 0 to not cache it")
+	flag.IntVar(&fPool, "pool", 0, "number of javascript VMs used to evaluate the PAC in parallel, 0 for one per CPU")
+	flag.StringVar(&fUpstreamCA, "https-ca", "", "PEM CA bundle used to verify HTTPS upstream proxies instead of the system roots")
+	flag.StringVar(&fUpstreamCert, "https-cert", "", "PEM client certificate to present to HTTPS upstream proxies")
+	flag.StringVar(&fUpstreamKey, "https-key", "", "PEM private key for -https-cert")
+	flag.StringVar(&fUpstreamSNI, "https-sni", "", "server name to send to, and verify for, HTTPS upstream proxies instead of their hostname")
+	flag.StringVar(&fSelector, "selector", "first", "how to choose between the proxies in a PAC result: first, round-robin, random, weighted, host-hash or latency")
+	flag.Var(fWeight, "weight", "proxy weight for the weighted selector as host:port=weight, may be repeated")
+	flag.Float64Var(&fAlpha, "latency-alpha", 0.3, "weight given to each new connect latency sample by the latency selector")
+	flag.Float64Var(&fExplore, "latency-explore", 0.05, "chance of the latency selector trying a slower proxy first so that it gets measured again")
+	flag.IntVar(&fRace, "connect-race", 1, "number of PAC result entries to race when connecting a CONNECT tunnel, 1 to try them one at a time")
+	flag.DurationVar(&fRaceDelay, "connect-race-delay", 250*time.Millisecond, "delay before racing the next entry for -connect-race")
+	flag.DurationVar(&fRetry, "retry", 5*time.Minute, "how long an upstream proxy that failed is skipped for before it is retried, doubling on each consecutive failure")
+	flag.DurationVar(&fRetryMax, "retry-max", time.Hour, "upper limit for -retry after repeated failures")
+	flag.DurationVar(&fProbe, "probe", 0, "interval at which to probe upstream proxies seen in PAC results, 0 to disable")
+	flag.DurationVar(&fProbeTimeout, "probe-timeout", 5*time.Second, "timeout for each probe")
+	flag.StringVar(&fProbeCanary, "probe-canary", "", "host:port that probes ask upstream proxies to connect to, rather than only connecting to the proxy")
+	flag.DurationVar(&fProbeExpiry, "probe-expiry", 30*time.Minute, "stop probing upstream proxies that have not been seen in PAC results for this long")
+	flag.Var(fProbeProxy, "probe-proxy", "per proxy probe settings as host:port=interval[,canary], may be repeated")
 }
 
 func main() {
@@ -45,16 +145,133 @@ func main() {
 	}
 	flag.Parse()
 
-	seen := make(map[string]bool)
-	flag.Visit(func(f *flag.Flag) { seen[f.Name] = true })
-	required := []string{"c"}
-	for _, req := range required {
-		if !seen[req] {
-			exitWithUsage(fmt.Sprintf("Missing required flag -%s", req))
+	if len(fPac) == 0 {
+		fPac = stringsFlag{"wpad"}
+	}
+	var pacFiles []string
+	for _, thing := range fPac {
+		if strings.TrimSpace(thing) == "" {
+			exitWithUsage("Unexpected empty value for -c")
+		}
+		if info, err := os.Stat(thing); err == nil && !info.IsDir() {
+			pacFiles = append(pacFiles, thing)
+		}
+	}
+	if fWatch && len(pacFiles) == 0 {
+		exitWithUsage("Unexpected value for -c, -watch needs at least one to be a PAC file")
+	}
+	if fPool < 0 {
+		exitWithUsage("Unexpected negative value for -pool")
+	}
+	if fCache < 0 {
+		exitWithUsage("Unexpected negative value for -cache")
+	}
+	if fDNSCache < 0 {
+		exitWithUsage("Unexpected negative value for -dns-cache")
+	}
+	if fRace < 1 || fRaceDelay <= 0 {
+		exitWithUsage("Unexpected value for -connect-race or -connect-race-delay")
+	}
+	var (
+		sources     []pac.Source
+		httpSources []*pac.HTTPSource
+	)
+	resolver, err := newResolver()
+	if err != nil {
+		exitWithUsage(err.Error())
+	}
+	dnsCache, _ := resolver.(*pacfunc.DNSCache)
+	verify, err := newPACVerifier()
+	if err != nil {
+		exitWithUsage(err.Error())
+	}
+	verified := false
+	for _, thing := range fPac {
+		if thing == "wpad" {
+			wpadOpts := []pac.WPADLoaderOpt{pac.WPADResolver(resolver)}
+			if verify != nil {
+				wpadOpts = append(wpadOpts, pac.WPADVerify(verify))
+			}
+			sources = append(sources, pac.Source{Name: thing, Load: pac.NewWPADLoader(wpadOpts...).Load})
+			verified = true
+			continue
+		}
+		u, ok := pac.ParseHTTPURL(thing)
+		if !ok {
+			sources = append(sources, pac.NewSmartSource(thing))
+			continue
+		}
+		fetchOpts, err := newPACFetchOpts()
+		if err != nil {
+			exitWithUsage(err.Error())
+		}
+		source := pac.NewHTTPSource(u, fetchOpts...)
+		httpSources = append(httpSources, source)
+		load := source.Load
+		if verify != nil {
+			load = verify(load, u, func(u *url.URL) pac.Loader {
+				return pac.NewHTTPSource(u, fetchOpts...).Load
+			})
+		}
+		sources = append(sources, pac.Source{Name: thing, Load: load})
+		verified = true
+	}
+	if verify != nil && !verified {
+		exitWithUsage("-pac-sha256 and -pac-pubkey only check a PAC fetched from a URL or found by wpad, but -c has neither")
+	}
+	validate, err := newValidator(fEngine, resolver)
+	if err != nil {
+		exitWithUsage(err.Error())
+	}
+	sourceList := pac.NewSourceList(validate, sources...)
+	loader := pac.Loader(sourceList.Load)
+	pacStatus := func() string {
+		return fmt.Sprintf("ok, using %q", sourceList.Active())
+	}
+	commit := sourceList.Commit
+	if fLastGood != "" {
+		lastGood := pac.NewLastGoodLoader(loader, fLastGood)
+		loader = lastGood.Load
+		commit = func(pac string) {
+			sourceList.Commit(pac)
+			lastGood.Commit(pac)
+		}
+		activeStatus := pacStatus
+		pacStatus = func() string {
+			if lastGood.Degraded() != nil {
+				return lastGood.Status()
+			}
+			return activeStatus()
+		}
+	}
+	engine, err := newEngine(fEngine, loader, resolver, commit)
+	if err != nil {
+		exitWithUsage(err.Error())
+	}
+	var resultCache *pac.CachingFinder
+	if fCache > 0 {
+		var key pac.CacheKey
+		switch fCacheKey {
+		case "host":
+			key = pac.CacheKeyHost
+		case "url":
+			key = pac.CacheKeyURL
+		default:
+			exitWithUsage(fmt.Sprintf("Unknown cache key %q", fCacheKey))
 		}
+		if resultCache, err = pac.NewCachingFinder(
+			engine,
+			pac.CacheSize(fCache),
+			pac.CacheTTL(fCacheTTL),
+			pac.CacheKeyFunc(key),
+		); err != nil {
+			exitWithUsage(err.Error())
+		}
+		engine = resultCache
 	}
-	if strings.TrimSpace(fPac) == "" {
-		exitWithUsage("Unexpected empty value for -c")
+	selector, err := newProxySelector(fSelector, fWeight, fAlpha, fExplore)
+	if err != nil {
+		exitWithUsage(err.Error())
 	}
 
 	if fVerbose {
@@ -66,24 +283,85 @@ func main() {
 	log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile | log.LUTC)
 	log.Printf("Starting %s v%s", Name, Version)
 
-	otto := pac.NewOttoEngine(
-		pac.OttoLoader(pac.SmartLoader(fPac)),
-	)
-	if err := otto.Start(); err != nil {
+	if err := engine.Start(); err != nil {
+		log.Panic(err)
+	}
+	defer engine.Stop()
+
+	initSignalNotify(engine)
+
+	if fWatch {
+		for _, file := range pacFiles {
+			watcher := pac.NewFileWatcher(file, engine, pac.WatchPollInterval(fWatchPoll))
+			watcher.Start()
+			defer watcher.Stop()
+		}
+	}
+	if fRefresh > 0 {
+		for _, source := range httpSources {
+			refresher := pac.NewHTTPRefresher(
+				source,
+				engine,
+				pac.RefreshInterval(fRefresh),
+				pac.RefreshMinimum(fRefreshMin),
+			)
+			refresher.Start()
+			defer refresher.Stop()
+		}
+	}
+
+	upstreamTLS, err := newTLSConfig(fUpstreamCA, fUpstreamCert, fUpstreamKey, fUpstreamSNI)
+	if err != nil {
 		log.Panic(err)
 	}
-	defer otto.Stop()
+	upstream := newUpstreamDialer(upstreamTLS)
+
+	checker := pac.NewBadProxyList(
+		pac.BadProxyRetry(fRetry, fRetryMax),
+	)
+
+	proberOpts := []pac.ProxyProberOpt{
+		pac.ProbeDefaults(pac.ProbeConfig{
+			Interval: fProbe,
+			Timeout:  fProbeTimeout,
+			Canary:   fProbeCanary,
+		}),
+		pac.ProbeExpiry(fProbeExpiry),
+	}
+	for address, setting := range fProbeProxy {
+		proberOpts = append(proberOpts, pac.ProbeProxy(address, pac.ProbeConfig{
+			Interval: setting.interval,
+			Timeout:  fProbeTimeout,
+			Canary:   setting.canary,
+		}))
+	}
+	prober := pac.NewProxyProber(checker, upstream.probe, proberOpts...)
+	defer prober.Stop()
 
-	initSignalNotify(otto)
+	handlerOpts := []proxyHTTPHandlerOpt{
+		withUpstreamDialer(upstream),
+		withProxyChecker(checker),
+		withConnectRace(fRace, fRaceDelay),
+	}
+	if recorder, ok := selector.(pac.LatencyRecorder); ok {
+		handlerOpts = append(handlerOpts, withLatencyRecorder(recorder))
+	}
 
 	srv := &http.Server{
 		Addr:              fListen,
 		ReadHeaderTimeout: 2 * time.Second,
 		IdleTimeout:       60 * time.Second,
 		Handler: newProxyHTTPHandler(
-			otto,
-			&pac.FirstItemSelector{},
-			newNonProxyHTTPHandler(),
+			&pac.ObservedFinder{
+				Finder:  engine,
+				Observe: prober.Observe,
+			},
+			&pac.CheckedSelector{
+				Selector: selector,
+				Checker:  checker,
+			},
+			newNonProxyHTTPHandler(pacStatus, resultCache, dnsCache, checker.BadProxies),
+			handlerOpts...,
 		),
 	}
 	log.Printf("Listening on %q", fListen)
@@ -92,6 +370,104 @@ func main() {
 	}
 }
 
+// newValidator for PACs that the named engine will be given, so that a
+// source is only used when an engine configured the same way can run its PAC
+func newValidator(name string, resolver pacfunc.Resolver) (pac.Validator, error) {
+	engine, err := newEngine(name, nil, resolver, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch e := engine.(type) {
+	case *pac.OttoEngine:
+		return e.Validate, nil
+	case *pac.GojaEngine:
+		return e.Validate, nil
+	}
+	return nil, nil
+}
+
+func newEngine(name string, loader pac.Loader, resolver pacfunc.Resolver, commit func(pac string)) (pac.Engine, error) {
+	var fallback pac.Proxies
+	if fPacFallback != "" {
+		var err error
+		if fallback, err = pac.ParseFindProxyString(fPacFallback); err != nil {
+			return nil, fmt.Errorf("Unexpected value for -pac-fallback: %s", err)
+		}
+	}
+	var nower pacfunc.Nower = pacfunc.DefaultNower
+	if fNow != "" {
+		now, err := time.Parse(time.RFC3339, fNow)
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected value for -now: %s", err)
+		}
+		nower = pacfunc.NewStaticNower(now)
+	}
+	location := time.Local
+	if fTZ != "" {
+		var err error
+		if location, err = time.LoadLocation(fTZ); err != nil {
+			return nil, fmt.Errorf("Unexpected value for -tz: %s", err)
+		}
+	}
+	switch name {
+	case "otto":
+		opts := []pac.OttoEngineOpt{
+			pac.OttoLoader(loader),
+			pac.OttoEvalTimeout(fPacTimeout),
+			pac.OttoStartTimeout(fPacStart),
+			pac.OttoFallback(fallback),
+			pac.OttoResolver(resolver),
+			pac.OttoNower(nower),
+			pac.OttoLocation(location),
+			pac.OttoCommit(commit),
+		}
+		if fPool > 0 {
+			opts = append(opts, pac.OttoPoolSize(fPool))
+		}
+		return pac.NewOttoEngine(opts...), nil
+	case "goja":
+		opts := []pac.GojaEngineOpt{
+			pac.GojaLoader(loader),
+			pac.GojaEvalTimeout(fPacTimeout),
+			pac.GojaStartTimeout(fPacStart),
+			pac.GojaFallback(fallback),
+			pac.GojaResolver(resolver),
+			pac.GojaNower(nower),
+			pac.GojaLocation(location),
+			pac.GojaCommit(commit),
+		}
+		if fPool > 0 {
+			opts = append(opts, pac.GojaPoolSize(fPool))
+		}
+		return pac.NewGojaEngine(opts...), nil
+	}
+	return nil, fmt.Errorf("Unknown engine %q", name)
+}
+
+func newProxySelector(name string, weights map[string]int, alpha float64, explore float64) (pac.ProxySelector, error) {
+	switch name {
+	case "first":
+		return &pac.FirstItemSelector{}, nil
+	case "round-robin":
+		return &pac.RoundRobinSelector{}, nil
+	case "random":
+		return pac.NewRandomSelector(), nil
+	case "weighted":
+		return pac.NewWeightedSelector(weights), nil
+	case "host-hash":
+		return &pac.HostHashSelector{}, nil
+	case "latency":
+		if alpha <= 0 || alpha > 1 {
+			return nil, fmt.Errorf("Unexpected value %v for -latency-alpha, must be greater than 0 and at most 1", alpha)
+		}
+		if explore < 0 || explore > 1 {
+			return nil, fmt.Errorf("Unexpected value %v for -latency-explore, must be between 0 and 1", explore)
+		}
+		return pac.NewLatencySelector(alpha, explore), nil
+	}
+	return nil, fmt.Errorf("Unknown selector %q", name)
+}
+
 func exitWithUsage(message string) {
 	os.Stderr.WriteString(message)
 	os.Stderr.WriteString("\n")
@@ -20,7 +20,7 @@ func initSignalNotify(pac pac.EngineManager) {
 			case syscall.SIGHUP:
 				log.Print("SIGHUP")
 				if err := pac.Reload(); err != nil {
-					log.Panic(err)
+					log.Printf("failed to reload the PAC, carrying on with the current one: %s", err)
 				}
 			}
 		}
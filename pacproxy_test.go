@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/williambailey/pacproxy/pac"
+)
+
+func TestNewProxySelector(t *testing.T) {
+	tests := []struct {
+		name    string
+		alpha   float64
+		explore float64
+		ok      bool
+	}{
+		{"first", 0.3, 0.05, true},
+		{"round-robin", 0.3, 0.05, true},
+		{"random", 0.3, 0.05, true},
+		{"weighted", 0.3, 0.05, true},
+		{"host-hash", 0.3, 0.05, true},
+		{"latency", 0.3, 0.05, true},
+		{"latency", 1, 0, true},
+		{"latency", 0.3, 1, true},
+		{"latency", 0, 0.05, false},
+		{"latency", 1.5, 0.05, false},
+		{"latency", 0.3, -0.1, false},
+		{"latency", 0.3, 1.1, false},
+		{"unknown", 0.3, 0.05, false},
+	}
+	for _, tt := range tests {
+		s, err := newProxySelector(tt.name, map[string]int{"a.example.com:8080": 2}, tt.alpha, tt.explore)
+		if tt.ok && (err != nil || s == nil) {
+			t.Errorf("%s with alpha %v and explore %v: expected a selector, got %v", tt.name, tt.alpha, tt.explore, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s with alpha %v and explore %v: expected an error", tt.name, tt.alpha, tt.explore)
+		}
+	}
+	s, _ := newProxySelector("weighted", map[string]int{"a.example.com:8080": 0}, 0.3, 0.05)
+	a := pac.Proxy{Type: pac.ProxyTypeHTTP, Hostname: "a.example.com", Port: 8080}
+	b := pac.Proxy{Type: pac.ProxyTypeHTTP, Hostname: "b.example.com", Port: 8080}
+	if p := s.SelectProxy(pac.Proxies{a, b}); p != b {
+		t.Errorf("expected the weights to be passed to the weighted selector, got %q", p)
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -16,51 +19,69 @@ import (
 	"github.com/williambailey/pacproxy/pac"
 )
 
+// proxyHTTPHandlerOpt used to configure a proxyHTTPHandler via the newProxyHTTPHandler func
+type proxyHTTPHandlerOpt func(*proxyHTTPHandler)
+
+// withUpstreamDialer used to connect to, or by way of, upstream proxies
+func withUpstreamDialer(d *upstreamDialer) proxyHTTPHandlerOpt {
+	return func(h *proxyHTTPHandler) {
+		h.dial = d.dial
+	}
+}
+
+// withProxyChecker that is told about the success or failure of each upstream
+func withProxyChecker(checker pac.ProxyChecker) proxyHTTPHandlerOpt {
+	return func(h *proxyHTTPHandler) {
+		h.proxyChecker = checker
+	}
+}
+
+// withLatencyRecorder that is told how long each successful connection took
+func withLatencyRecorder(recorder pac.LatencyRecorder) proxyHTTPHandlerOpt {
+	return func(h *proxyHTTPHandler) {
+		h.latencyRecorder = recorder
+	}
+}
+
+// withConnectRace to race up to limit upstreams for CONNECT requests, starting
+// another every delay until one connects
+func withConnectRace(limit int, delay time.Duration) proxyHTTPHandlerOpt {
+	return func(h *proxyHTTPHandler) {
+		h.raceLimit = limit
+		h.raceDelay = delay
+	}
+}
+
 type proxyHTTPHandler struct {
 	proxyFinder     pac.ProxyFinder
 	proxySelector   pac.ProxySelector
-	httpClient      *http.Client
-	dialer          *net.Dialer
+	proxyChecker    pac.ProxyChecker
+	latencyRecorder pac.LatencyRecorder
+	raceLimit       int
+	raceDelay       time.Duration
+	dial            func(ctx context.Context, proxy pac.Proxy, addr string) (net.Conn, error)
 	nonProxyHandler http.Handler
+	mutex           sync.Mutex
+	httpClients     map[pac.Proxy]*http.Client
 }
 
 func newProxyHTTPHandler(
 	proxyFinder pac.ProxyFinder,
 	proxySelector pac.ProxySelector,
 	nonProxyHandler http.Handler,
+	opts ...proxyHTTPHandlerOpt,
 ) *proxyHTTPHandler {
-	dialer := &net.Dialer{
-		Timeout:   10 * time.Second,
-		KeepAlive: 10 * time.Second,
-	}
-	transport := &http.Transport{
-		DisableKeepAlives:     false,
-		DisableCompression:    false,
-		MaxIdleConns:          50,
-		MaxIdleConnsPerHost:   20,
-		IdleConnTimeout:       5 * time.Second,
-		ResponseHeaderTimeout: 60 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		Proxy:                 nil,
-		Dial:                  dialer.Dial,
-	}
-	handler := &proxyHTTPHandler{
-		proxyFinder:   proxyFinder,
-		proxySelector: proxySelector,
-		httpClient: &http.Client{
-			Transport: transport,
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				// Don't follow redirects, but do return their contents.
-				return http.ErrUseLastResponse
-			},
-			Jar: nil,
-		},
-		dialer:          dialer,
+	h := &proxyHTTPHandler{
+		proxyFinder:     proxyFinder,
+		proxySelector:   proxySelector,
+		dial:            newUpstreamDialer(&tls.Config{}).dial,
 		nonProxyHandler: nonProxyHandler,
+		httpClients:     make(map[pac.Proxy]*http.Client),
 	}
-	transport.Proxy = handler.lookupProxy
-	return handler
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 func (h *proxyHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -75,57 +96,198 @@ func (h *proxyHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *proxyHTTPHandler) lookupProxy(r *http.Request) (*url.URL, error) {
+// lookupProxies returns the PAC result for r in the order that the
+// upstreams should be tried, as decided by the proxy selector. A fallback
+// result that the finder returns along with an error is used as is.
+func (h *proxyHTTPHandler) lookupProxies(r *http.Request) (pac.Proxies, error) {
 	proxies, err := h.proxyFinder.FindProxyForURL(r.URL)
 	if err != nil {
-		return nil, err
+		if len(proxies) == 0 {
+			return nil, err
+		}
+		log.Printf("Proxy Lookup %q failed, using fallback %q: %s", r.URL, proxies, err)
 	}
-	proxy := h.proxySelector.SelectProxy(proxies)
-	log.Printf("Proxy Lookup %q, got %q. Selected %q", r.URL, proxies, proxy)
-	if proxy == pac.DirectProxy {
-		return nil, nil
+	if len(proxies) == 0 {
+		proxies = pac.Proxies{pac.DirectProxy}
 	}
-	proxyURL := &url.URL{
-		Host: fmt.Sprintf("%s:%d", proxy.Hostname, proxy.Port),
+	ordered := pac.OrderProxies(h.proxySelector, r.URL, proxies)
+	log.Printf("Proxy Lookup %q, got %q. Trying %q", r.URL, proxies, ordered)
+	return ordered, nil
+}
+
+// upstreamDialError is a failure to connect to, or by way of, an upstream.
+// Nothing has been sent at that point so the next upstream can be tried.
+type upstreamDialError struct {
+	proxy pac.Proxy
+	err   error
+}
+
+func (e *upstreamDialError) Error() string {
+	return fmt.Sprintf("%s: %s", e.proxy, e.err)
+}
+
+func (e *upstreamDialError) Unwrap() error {
+	return e.err
+}
+
+// httpClientFor returns the client used to send plain HTTP requests by way
+// of proxy. Each upstream gets its own transport so that idle connections
+// are never shared between upstreams.
+func (h *proxyHTTPHandler) httpClientFor(proxy pac.Proxy) *http.Client {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if client, ok := h.httpClients[proxy]; ok {
+		return client
 	}
-	if proxyAuth := r.Header.Get("Proxy-Authorization"); proxyAuth != "" {
-		if u, p, ok := parseBasicAuth(proxyAuth); ok {
-			proxyURL.User = url.UserPassword(u, p)
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := h.dialUpstream(ctx, proxy, addr)
+		if err != nil {
+			return nil, &upstreamDialError{proxy, err}
 		}
+		return conn, nil
 	}
-	return proxyURL, nil
+	transport := &http.Transport{
+		DisableKeepAlives:     false,
+		DisableCompression:    false,
+		MaxIdleConns:          50,
+		MaxIdleConnsPerHost:   20,
+		IdleConnTimeout:       5 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		Proxy:                 nil,
+		DialContext:           dial,
+	}
+	switch proxy.Type {
+	case pac.ProxyTypeHTTP:
+		transport.Proxy = func(r *http.Request) (*url.URL, error) {
+			return proxyURL(proxy, r), nil
+		}
+	case pac.ProxyTypeHTTPS:
+		transport.Proxy = func(r *http.Request) (*url.URL, error) {
+			return proxyURL(proxy, r), nil
+		}
+		// Only used for the TLS connection to the proxy itself, as the
+		// proxy URL is the first hop.
+		transport.DialTLSContext = dial
+	}
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// Don't follow redirects, but do return their contents.
+			return http.ErrUseLastResponse
+		},
+		Jar: nil,
+	}
+	h.httpClients[proxy] = client
+	return client
+}
+
+// dialUpstream using the upstream dialer, timing successful connections
+func (h *proxyHTTPHandler) dialUpstream(ctx context.Context, proxy pac.Proxy, addr string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := h.dial(ctx, proxy, addr)
+	if err == nil && h.latencyRecorder != nil {
+		h.latencyRecorder.RecordLatency(proxy, time.Since(start))
+	}
+	return conn, err
+}
+
+// connectUpstream for a CONNECT request, trying each of proxies in turn.
+//
+// When racing is enabled the next proxy is also tried if the current ones
+// haven't connected within the race delay, up to the race limit, and the
+// first to connect wins. A failure always moves on to the next proxy.
+func (h *proxyHTTPHandler) connectUpstream(r *http.Request, proxies pac.Proxies) (pac.Proxy, net.Conn, error) {
+	type dialResult struct {
+		proxy pac.Proxy
+		conn  net.Conn
+		err   error
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	results := make(chan dialResult, len(proxies))
+	next, pending := 0, 0
+	start := func() {
+		proxy := proxies[next]
+		next++
+		pending++
+		go func() {
+			conn, err := h.dialUpstream(ctx, proxy, r.URL.Host)
+			results <- dialResult{proxy, conn, err}
+		}()
+	}
+	var raceC <-chan time.Time
+	if h.raceLimit > 1 {
+		race := time.NewTicker(h.raceDelay)
+		defer race.Stop()
+		raceC = race.C
+	}
+
+	start()
+	var err error
+	for pending > 0 {
+		select {
+		case <-raceC:
+			if next < len(proxies) && next < h.raceLimit {
+				log.Printf("HTTP Connect Proxy %q: racing %q", r.URL, proxies[next])
+				start()
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				h.recordSuccess(res.proxy)
+				go func(pending int) {
+					// Tidy up after any losers, still recording those that
+					// failed for reasons other than losing.
+					for ; pending > 0; pending-- {
+						res := <-results
+						if res.conn != nil {
+							res.conn.Close()
+						} else if !errors.Is(res.err, context.Canceled) {
+							h.recordFailure(res.proxy, res.err)
+						}
+					}
+				}(pending)
+				return res.proxy, res.conn, nil
+			}
+			err = res.err
+			h.recordFailure(res.proxy, err)
+			log.Printf("HTTP Connect Proxy %q: unable to connect using %q: %s", r.URL, res.proxy, err)
+			if next < len(proxies) {
+				start()
+			}
+		}
+	}
+	return pac.Proxy{}, nil, err
 }
 
 func (h *proxyHTTPHandler) doConnectProxy(w http.ResponseWriter, r *http.Request) {
 	var (
 		clientConn net.Conn
 		serverConn net.Conn
+		proxy      pac.Proxy
 		err        error
 	)
 
-	proxyURL, err := h.lookupProxy(r)
+	proxies, err := h.lookupProxies(r)
 	if err != nil {
 		log.Printf("HTTP Connect Proxy %q: %d %s", r.URL, http.StatusBadGateway, err)
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
 
-	if proxyURL == nil {
-		serverConn, err = h.dialer.Dial("tcp", r.URL.Host)
-		if err != nil {
-			log.Printf("HTTP Connect Proxy %q: %d %s", r.URL, http.StatusBadGateway, err)
-			http.Error(w, err.Error(), http.StatusBadGateway)
-			return
-		}
-		defer serverConn.Close()
-	} else {
-		serverConn, err = h.dialer.Dial("tcp", proxyURL.Hostname()+":"+proxyURL.Port())
-		if err != nil {
-			log.Printf("HTTP Connect Proxy %q: %d %s", r.URL, http.StatusBadGateway, err)
-			http.Error(w, err.Error(), http.StatusBadGateway)
-			return
-		}
-		defer serverConn.Close()
+	proxy, serverConn, err = h.connectUpstream(r, proxies)
+	if err != nil {
+		log.Printf("HTTP Connect Proxy %q: %d %s", r.URL, http.StatusBadGateway, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer serverConn.Close()
+	// DIRECT and SOCKS give us a connection to the requested host, while
+	// for HTTP proxies we pass the CONNECT on and relay their response.
+	tunnelled := proxy == pac.DirectProxy || proxy.Type.IsSOCKS()
+	if !tunnelled {
 		removeProxyHeaders(r)
 		//r.WriteProxy(serverConn)
 		r.Write(serverConn) // instead of WriteProxy as this will *hopefully* deal with CONNECT correctly.
@@ -144,7 +306,7 @@ func (h *proxyHTTPHandler) doConnectProxy(w http.ResponseWriter, r *http.Request
 		return
 	}
 	defer clientConn.Close()
-	if proxyURL == nil {
+	if tunnelled {
 		clientConn.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
 	}
 	var wg sync.WaitGroup
@@ -163,8 +325,37 @@ func (h *proxyHTTPHandler) doConnectProxy(w http.ResponseWriter, r *http.Request
 }
 
 func (h *proxyHTTPHandler) doHTTPProxy(w http.ResponseWriter, r *http.Request) {
+	var (
+		resp *http.Response
+		err  error
+	)
+
+	proxies, err := h.lookupProxies(r)
+	if err != nil {
+		log.Printf("HTTP Proxy %q: %d %s", r.URL, http.StatusBadGateway, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
 	removeProxyHeaders(r)
-	resp, err := h.httpClient.Do(r)
+	if r.Body != nil && r.Body != http.NoBody {
+		// The transport closes the body when a request fails. It won't have
+		// been read if we failed to connect, so keep it open for the next
+		// upstream.
+		r.Body = ioutil.NopCloser(r.Body)
+	}
+	for _, proxy := range proxies {
+		resp, err = h.httpClientFor(proxy).Do(r)
+		if err == nil {
+			h.recordSuccess(proxy)
+			break
+		}
+		var dialErr *upstreamDialError
+		if !errors.As(err, &dialErr) {
+			break
+		}
+		h.recordFailure(proxy, dialErr.err)
+		log.Printf("HTTP Proxy %q: unable to connect using %q: %s", r.URL, proxy, err)
+	}
 	if err != nil && resp == nil {
 		log.Printf("HTTP Proxy %q: %d %s", r.URL, http.StatusBadGateway, err)
 		http.Error(w, err.Error(), http.StatusBadGateway)
@@ -178,6 +369,36 @@ func (h *proxyHTTPHandler) doHTTPProxy(w http.ResponseWriter, r *http.Request) {
 	io.Copy(w, resp.Body)
 }
 
+func (h *proxyHTTPHandler) recordSuccess(proxy pac.Proxy) {
+	if h.proxyChecker != nil {
+		h.proxyChecker.RecordSuccess(proxy)
+	}
+}
+
+func (h *proxyHTTPHandler) recordFailure(proxy pac.Proxy, err error) {
+	if h.proxyChecker != nil {
+		h.proxyChecker.RecordFailure(proxy, err)
+	}
+}
+
+// proxyURL for an upstream HTTP or HTTPS proxy, passing on any basic auth
+// credentials the client supplied.
+func proxyURL(proxy pac.Proxy, r *http.Request) *url.URL {
+	u := &url.URL{
+		Scheme: "http",
+		Host:   proxy.Address(),
+	}
+	if proxy.Type == pac.ProxyTypeHTTPS {
+		u.Scheme = "https"
+	}
+	if proxyAuth := r.Header.Get("Proxy-Authorization"); proxyAuth != "" {
+		if user, pass, ok := parseBasicAuth(proxyAuth); ok {
+			u.User = url.UserPassword(user, pass)
+		}
+	}
+	return u
+}
+
 func removeProxyHeaders(r *http.Request) {
 	// this must be reset when serving a request with the client
 	r.RequestURI = ""
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/williambailey/pacproxy/pac"
+)
+
+var (
+	raceA = pac.Proxy{Type: pac.ProxyTypeHTTP, Hostname: "a.example.com", Port: 8080}
+	raceB = pac.Proxy{Type: pac.ProxyTypeHTTP, Hostname: "b.example.com", Port: 8080}
+	raceC = pac.Proxy{Type: pac.ProxyTypeHTTP, Hostname: "c.example.com", Port: 8080}
+)
+
+// stubDial is how the stubDialer answers for a proxy. serve, when set, is
+// given the far end of the connection.
+type stubDial struct {
+	delay        time.Duration
+	err          error
+	ignoreCancel bool
+	serve        func(conn net.Conn)
+}
+
+// stubDialer connects to each proxy after its delay, handing out one end of
+// a pipe, and keeps track of what was dialed and closed
+type stubDialer struct {
+	dials  map[pac.Proxy]stubDial
+	mutex  sync.Mutex
+	dialed []pac.Proxy
+	closed map[pac.Proxy]chan struct{}
+}
+
+func newStubDialer(dials map[pac.Proxy]stubDial) *stubDialer {
+	d := &stubDialer{
+		dials:  dials,
+		closed: make(map[pac.Proxy]chan struct{}),
+	}
+	for p := range dials {
+		d.closed[p] = make(chan struct{})
+	}
+	return d
+}
+
+func (d *stubDialer) dial(ctx context.Context, proxy pac.Proxy, addr string) (net.Conn, error) {
+	d.mutex.Lock()
+	d.dialed = append(d.dialed, proxy)
+	d.mutex.Unlock()
+	s := d.dials[proxy]
+	done := ctx.Done()
+	if s.ignoreCancel {
+		done = nil
+	}
+	select {
+	case <-time.After(s.delay):
+	case <-done:
+		return nil, ctx.Err()
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	conn, other := net.Pipe()
+	if s.serve != nil {
+		go s.serve(other)
+	} else {
+		other.Close()
+	}
+	return &stubConn{Conn: conn, closed: d.closed[proxy]}, nil
+}
+
+func (d *stubDialer) dialedProxies() []pac.Proxy {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]pac.Proxy{}, d.dialed...)
+}
+
+// stubConn closes its closed channel when it is closed
+type stubConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *stubConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+func newRaceHandler(d *stubDialer, checker pac.ProxyChecker, limit int, delay time.Duration) *proxyHTTPHandler {
+	h := newProxyHTTPHandler(nil, &pac.FirstItemSelector{}, nil, withProxyChecker(checker), withConnectRace(limit, delay))
+	h.dial = d.dial
+	return h
+}
+
+func TestConnectUpstreamRaceSlowFirstProxy(t *testing.T) {
+	d := newStubDialer(map[pac.Proxy]stubDial{
+		raceA: {delay: 5 * time.Second},
+		raceB: {delay: 0},
+	})
+	checker := pac.NewBadProxyList()
+	h := newRaceHandler(d, checker, 2, 20*time.Millisecond)
+	start := time.Now()
+	proxy, conn, err := h.connectUpstream(httptest.NewRequest("CONNECT", "www.example.com:443", nil), pac.Proxies{raceA, raceB})
+	if err != nil {
+		t.Fatalf("unexpected error: %q", err)
+	}
+	defer conn.Close()
+	if proxy != raceB {
+		t.Errorf("expected %q to win the race, got %q", raceB, proxy)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("expected the race to be won quickly, took %s", took)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(checker.BadProxies()) != 0 {
+		t.Errorf("expected losing the race not to be a failure, got %v", checker.BadProxies())
+	}
+}
+
+func TestConnectUpstreamRaceClosesLosers(t *testing.T) {
+	d := newStubDialer(map[pac.Proxy]stubDial{
+		raceA: {delay: 100 * time.Millisecond, ignoreCancel: true},
+		raceB: {delay: 0},
+	})
+	checker := pac.NewBadProxyList()
+	h := newRaceHandler(d, checker, 2, 20*time.Millisecond)
+	proxy, conn, err := h.connectUpstream(httptest.NewRequest("CONNECT", "www.example.com:443", nil), pac.Proxies{raceA, raceB})
+	if err != nil {
+		t.Fatalf("unexpected error: %q", err)
+	}
+	defer conn.Close()
+	if proxy != raceB {
+		t.Errorf("expected %q to win the race, got %q", raceB, proxy)
+	}
+	select {
+	case <-d.closed[raceA]:
+	case <-time.After(time.Second):
+		t.Errorf("expected the connection to %q that lost the race to be closed", raceA)
+	}
+	select {
+	case <-d.closed[raceB]:
+		t.Errorf("expected the connection to %q that won the race to be left open", raceB)
+	default:
+	}
+	if len(checker.BadProxies()) != 0 {
+		t.Errorf("expected losing the race not to be a failure, got %v", checker.BadProxies())
+	}
+}
+
+func TestConnectUpstreamRaceAllFail(t *testing.T) {
+	errA := errors.New("a failed")
+	errC := errors.New("c failed")
+	d := newStubDialer(map[pac.Proxy]stubDial{
+		raceA: {delay: 50 * time.Millisecond, err: errA},
+		raceB: {delay: 0, err: errors.New("b failed")},
+		raceC: {delay: 100 * time.Millisecond, err: errC},
+	})
+	checker := pac.NewBadProxyList()
+	h := newRaceHandler(d, checker, 2, 20*time.Millisecond)
+	_, conn, err := h.connectUpstream(httptest.NewRequest("CONNECT", "www.example.com:443", nil), pac.Proxies{raceA, raceB, raceC})
+	if conn != nil {
+		t.Errorf("expected no connection, got %v", conn)
+	}
+	if err != errC {
+		t.Errorf("expected the last failure %q, got %v", errC, err)
+	}
+	if dialed := d.dialedProxies(); len(dialed) != 3 {
+		t.Errorf("expected all 3 proxies to be tried, got %q", dialed)
+	}
+	if bad := checker.BadProxies(); len(bad) != 3 {
+		t.Errorf("expected all 3 proxies to be marked as bad, got %v", bad)
+	}
+}
+
+func TestConnectUpstreamWithoutRacing(t *testing.T) {
+	d := newStubDialer(map[pac.Proxy]stubDial{
+		raceA: {delay: 100 * time.Millisecond},
+		raceB: {delay: 0},
+	})
+	h := newRaceHandler(d, pac.NewBadProxyList(), 1, time.Millisecond)
+	proxy, conn, err := h.connectUpstream(httptest.NewRequest("CONNECT", "www.example.com:443", nil), pac.Proxies{raceA, raceB})
+	if err != nil {
+		t.Fatalf("unexpected error: %q", err)
+	}
+	conn.Close()
+	if proxy != raceA {
+		t.Errorf("expected %q without racing, got %q", raceA, proxy)
+	}
+	if dialed := d.dialedProxies(); len(dialed) != 1 {
+		t.Errorf("expected only %q to be tried, got %q", raceA, dialed)
+	}
+
+	// a failure still moves on to the next proxy
+	d = newStubDialer(map[pac.Proxy]stubDial{
+		raceA: {delay: 0, err: errors.New("a failed")},
+		raceB: {delay: 0},
+	})
+	h = newRaceHandler(d, pac.NewBadProxyList(), 1, time.Millisecond)
+	proxy, conn, err = h.connectUpstream(httptest.NewRequest("CONNECT", "www.example.com:443", nil), pac.Proxies{raceA, raceB})
+	if err != nil {
+		t.Fatalf("unexpected error: %q", err)
+	}
+	conn.Close()
+	if proxy != raceB {
+		t.Errorf("expected %q after %q failed, got %q", raceB, raceA, proxy)
+	}
+}
+
+// staticFinder finds the same proxies for every URL
+type staticFinder pac.Proxies
+
+func (f staticFinder) FindProxyForURL(u *url.URL) (pac.Proxies, error) {
+	return pac.Proxies(f), nil
+}
+
+// serveEchoProxy answers one request as an HTTP proxy would, with a body
+// describing the request that it was sent
+func serveEchoProxy(conn net.Conn) {
+	defer conn.Close()
+	r, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	echo := fmt.Sprintf("%s %s %s", r.Method, r.URL, body)
+	fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(echo), echo)
+}
+
+// closableBody can't be read once closed, like the body of a request to a
+// server
+type closableBody struct {
+	*strings.Reader
+	closed bool
+}
+
+func (b *closableBody) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, errors.New("read after close")
+	}
+	return b.Reader.Read(p)
+}
+
+func (b *closableBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+// serveEcho sends back everything that it is sent
+func serveEcho(conn net.Conn) {
+	defer conn.Close()
+	io.Copy(conn, conn)
+}
+
+func newFailoverHandler(d *stubDialer, checker pac.ProxyChecker, proxies ...pac.Proxy) *proxyHTTPHandler {
+	h := newProxyHTTPHandler(staticFinder(proxies), &pac.FirstItemSelector{}, nil, withProxyChecker(checker))
+	h.dial = d.dial
+	return h
+}
+
+// assertBadProxies checks that exactly expected are marked as bad
+func assertBadProxies(t *testing.T, checker *pac.BadProxyList, expected ...pac.Proxy) {
+	bad := checker.BadProxies()
+	if len(bad) != len(expected) {
+		t.Errorf("expected %d bad proxies, got %v", len(expected), bad)
+		return
+	}
+	marked := make(map[pac.Proxy]bool)
+	for _, b := range bad {
+		marked[b.Proxy] = true
+	}
+	for _, p := range expected {
+		if !marked[p] {
+			t.Errorf("expected %q to be marked as bad, got %v", p, bad)
+		}
+	}
+}
+
+func TestHTTPProxyFailover(t *testing.T) {
+	d := newStubDialer(map[pac.Proxy]stubDial{
+		raceA: {err: errors.New("a failed")},
+		raceB: {err: errors.New("b failed")},
+		raceC: {serve: serveEchoProxy},
+	})
+	checker := pac.NewBadProxyList()
+	h := newFailoverHandler(d, checker, raceA, raceB, raceC)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://www.example.com/page.html", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if body := w.Body.String(); body != "GET http://www.example.com/page.html " {
+		t.Errorf("unexpected response %q", body)
+	}
+	if dialed := d.dialedProxies(); len(dialed) != 3 {
+		t.Errorf("expected all 3 proxies to be tried, got %q", dialed)
+	}
+	assertBadProxies(t, checker, raceA, raceB)
+}
+
+func TestHTTPProxyFailoverKeepsBody(t *testing.T) {
+	d := newStubDialer(map[pac.Proxy]stubDial{
+		raceA: {err: errors.New("a failed")},
+		raceB: {serve: serveEchoProxy},
+	})
+	checker := pac.NewBadProxyList()
+	h := newFailoverHandler(d, checker, raceA, raceB)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "http://www.example.com/form", nil)
+	r.Body = &closableBody{Reader: strings.NewReader("name=value")}
+	r.ContentLength = int64(len("name=value"))
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if body := w.Body.String(); body != "POST http://www.example.com/form name=value" {
+		t.Errorf("expected the body to be sent after the retry, got %q", body)
+	}
+	assertBadProxies(t, checker, raceA)
+}
+
+func TestHTTPProxyAllFail(t *testing.T) {
+	d := newStubDialer(map[pac.Proxy]stubDial{
+		raceA: {err: errors.New("a failed")},
+		raceB: {err: errors.New("b failed")},
+	})
+	checker := pac.NewBadProxyList()
+	h := newFailoverHandler(d, checker, raceA, raceB)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://www.example.com/page.html", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected status %d, got %d", http.StatusBadGateway, w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "b failed") {
+		t.Errorf("expected the last failure in the response, got %q", body)
+	}
+	assertBadProxies(t, checker, raceA, raceB)
+}
+
+func TestConnectProxyFailover(t *testing.T) {
+	d := newStubDialer(map[pac.Proxy]stubDial{
+		raceA:           {err: errors.New("a failed")},
+		raceB:           {err: errors.New("b failed")},
+		pac.DirectProxy: {serve: serveEcho},
+	})
+	checker := pac.NewBadProxyList()
+	srv := httptest.NewServer(newFailoverHandler(d, checker, raceA, raceB, pac.DirectProxy))
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "CONNECT www.example.com:443 HTTP/1.1\r\nHost: www.example.com:443\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	fmt.Fprint(conn, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("expected the tunnel to echo %q, got %q, %v", "ping", buf, err)
+	}
+	if dialed := d.dialedProxies(); len(dialed) != 3 {
+		t.Errorf("expected all 3 proxies to be tried, got %q", dialed)
+	}
+	assertBadProxies(t, checker, raceA, raceB)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/williambailey/pacproxy/pac"
+)
+
+var socks4Replies = map[byte]string{
+	0x5b: "request rejected or failed",
+	0x5c: "request rejected because the SOCKS server cannot connect to identd on the client",
+	0x5d: "request rejected because the client program and identd report different user-ids",
+}
+
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// socksConnect asks the SOCKS server at the other end of conn to connect to
+// addr. "SOCKS" and "SOCKS4" use SOCKS4, falling back to SOCKS4a when addr
+// is not an IPv4 address, and "SOCKS5" uses SOCKS5 without authentication.
+func socksConnect(conn net.Conn, proxyType pac.ProxyType, addr string, timeout time.Duration) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	switch proxyType {
+	case pac.ProxyTypeSOCKS, pac.ProxyTypeSOCKS4:
+		return socks4Connect(conn, host, uint16(port))
+	case pac.ProxyTypeSOCKS5:
+		return socks5Connect(conn, host, uint16(port))
+	}
+	return fmt.Errorf("unsupported SOCKS proxy type %q", proxyType)
+}
+
+func socks4Connect(conn net.Conn, host string, port uint16) error {
+	req := []byte{0x04, 0x01, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], port)
+	ip := net.ParseIP(host).To4()
+	if ip != nil {
+		req = append(req, ip...)
+		req = append(req, 0x00) // empty user id
+	} else {
+		// SOCKS4a, let the server resolve the hostname
+		req = append(req, 0, 0, 0, 1, 0x00)
+		req = append(req, host...)
+		req = append(req, 0x00)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	resp := make([]byte, 8)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != 0x00 {
+		return fmt.Errorf("unexpected SOCKS4 reply version %d", resp[0])
+	}
+	if resp[1] != 0x5a {
+		if msg, ok := socks4Replies[resp[1]]; ok {
+			return errors.New("socks4: " + msg)
+		}
+		return fmt.Errorf("socks4: unknown reply code %d", resp[1])
+	}
+	return nil
+}
+
+func socks5Connect(conn net.Conn, host string, port uint16) error {
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != 0x05 {
+		return fmt.Errorf("unexpected SOCKS5 reply version %d", resp[0])
+	}
+	if resp[1] != 0x00 {
+		return errors.New("socks5: no acceptable authentication methods")
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("socks5: hostname %q is too long", host)
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 0x01)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	resp = make([]byte, 4)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != 0x05 {
+		return fmt.Errorf("unexpected SOCKS5 reply version %d", resp[0])
+	}
+	if resp[1] != 0x00 {
+		if msg, ok := socks5Replies[resp[1]]; ok {
+			return errors.New("socks5: " + msg)
+		}
+		return fmt.Errorf("socks5: unknown reply code %d", resp[1])
+	}
+	// Discard the bound address and port
+	var skip int
+	switch resp[3] {
+	case 0x01:
+		skip = net.IPv4len + 2
+	case 0x04:
+		skip = net.IPv6len + 2
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		skip = int(l[0]) + 2
+	default:
+		return fmt.Errorf("socks5: unknown bound address type %d", resp[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip)); err != nil {
+		return err
+	}
+	return nil
+}
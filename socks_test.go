@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/williambailey/pacproxy/pac"
+)
+
+// socksExchange is a request that the fake SOCKS server expects to read
+// followed by the reply that it writes back
+type socksExchange struct {
+	expect []byte
+	reply  []byte
+}
+
+// fakeSOCKSServer plays out exchanges on conn, sending the outcome on the
+// returned channel
+func fakeSOCKSServer(conn net.Conn, exchanges ...socksExchange) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		defer conn.Close()
+		for _, e := range exchanges {
+			got := make([]byte, len(e.expect))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				result <- err
+				return
+			}
+			if !bytes.Equal(got, e.expect) {
+				result <- fmt.Errorf("expected request % x, got % x", e.expect, got)
+				return
+			}
+			if _, err := conn.Write(e.reply); err != nil {
+				result <- err
+				return
+			}
+		}
+		result <- nil
+	}()
+	return result
+}
+
+func assertSOCKSConnect(t *testing.T, name string, proxyType pac.ProxyType, addr string, e string, exchanges ...socksExchange) {
+	client, server := net.Pipe()
+	result := fakeSOCKSServer(server, exchanges...)
+	err := socksConnect(client, proxyType, addr, time.Second)
+	client.Close()
+	if e == "" && err != nil {
+		t.Errorf("%s: unexpected error: %q", name, err)
+	}
+	if e != "" && (err == nil || err.Error() != e) {
+		t.Errorf("%s: expecting error %q, got %v", name, e, err)
+	}
+	if err := <-result; err != nil && e == "" {
+		t.Errorf("%s: server: %s", name, err)
+	}
+}
+
+func TestSOCKS4Connect(t *testing.T) {
+	ipRequest := []byte{0x04, 0x01, 0x01, 0xbb, 192, 0, 2, 1, 0x00}
+	tests := []struct {
+		name    string
+		addr    string
+		request []byte
+		reply   []byte
+		err     string
+	}{
+		{"IPv4", "192.0.2.1:443", ipRequest, []byte{0x00, 0x5a, 0, 0, 0, 0, 0, 0}, ""},
+		{
+			"SOCKS4a",
+			"www.example.com:80",
+			append([]byte{0x04, 0x01, 0x00, 0x50, 0, 0, 0, 1, 0x00}, append([]byte("www.example.com"), 0x00)...),
+			[]byte{0x00, 0x5a, 0, 0, 0, 0, 0, 0},
+			"",
+		},
+		{"Rejected", "192.0.2.1:443", ipRequest, []byte{0x00, 0x5b, 0, 0, 0, 0, 0, 0}, "socks4: request rejected or failed"},
+		{"NoIdentd", "192.0.2.1:443", ipRequest, []byte{0x00, 0x5c, 0, 0, 0, 0, 0, 0}, "socks4: request rejected because the SOCKS server cannot connect to identd on the client"},
+		{"IdentdMismatch", "192.0.2.1:443", ipRequest, []byte{0x00, 0x5d, 0, 0, 0, 0, 0, 0}, "socks4: request rejected because the client program and identd report different user-ids"},
+		{"UnknownReply", "192.0.2.1:443", ipRequest, []byte{0x00, 0x42, 0, 0, 0, 0, 0, 0}, "socks4: unknown reply code 66"},
+		{"BadVersion", "192.0.2.1:443", ipRequest, []byte{0x05, 0x5a, 0, 0, 0, 0, 0, 0}, "unexpected SOCKS4 reply version 5"},
+	}
+	for _, tt := range tests {
+		for _, proxyType := range []pac.ProxyType{pac.ProxyTypeSOCKS, pac.ProxyTypeSOCKS4} {
+			assertSOCKSConnect(t, string(proxyType)+" "+tt.name, proxyType, tt.addr, tt.err, socksExchange{tt.request, tt.reply})
+		}
+	}
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	greeting := socksExchange{[]byte{0x05, 0x01, 0x00}, []byte{0x05, 0x00}}
+	ipRequest := []byte{0x05, 0x01, 0x00, 0x01, 192, 0, 2, 1, 0x01, 0xbb}
+	ipv4Bound := []byte{0x01, 192, 0, 2, 2, 0x04, 0x00}
+	tests := []struct {
+		name    string
+		addr    string
+		request []byte
+		reply   []byte
+		err     string
+	}{
+		{"IPv4", "192.0.2.1:443", ipRequest, append([]byte{0x05, 0x00, 0x00}, ipv4Bound...), ""},
+		{
+			"IPv6",
+			"[2001:db8::1]:443",
+			[]byte{0x05, 0x01, 0x00, 0x04, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x01, 0xbb},
+			append([]byte{0x05, 0x00, 0x00, 0x04}, make([]byte, net.IPv6len+2)...),
+			"",
+		},
+		{
+			"Hostname",
+			"www.example.com:80",
+			append(append([]byte{0x05, 0x01, 0x00, 0x03, 15}, "www.example.com"...), 0x00, 0x50),
+			append(append([]byte{0x05, 0x00, 0x00, 0x03, 11}, "example.net"...), 0x04, 0x00),
+			"",
+		},
+		{"UnknownBoundAddress", "192.0.2.1:443", ipRequest, []byte{0x05, 0x00, 0x00, 0x09}, "socks5: unknown bound address type 9"},
+		{"UnknownReply", "192.0.2.1:443", ipRequest, append([]byte{0x05, 0x42, 0x00}, ipv4Bound...), "socks5: unknown reply code 66"},
+		{"BadVersion", "192.0.2.1:443", ipRequest, append([]byte{0x04, 0x00, 0x00}, ipv4Bound...), "unexpected SOCKS5 reply version 4"},
+	}
+	for code, msg := range socks5Replies {
+		tests = append(tests, struct {
+			name    string
+			addr    string
+			request []byte
+			reply   []byte
+			err     string
+		}{
+			fmt.Sprintf("Reply%d", code),
+			"192.0.2.1:443",
+			ipRequest,
+			append([]byte{0x05, code, 0x00}, ipv4Bound...),
+			"socks5: " + msg,
+		})
+	}
+	for _, tt := range tests {
+		assertSOCKSConnect(t, "SOCKS5 "+tt.name, pac.ProxyTypeSOCKS5, tt.addr, tt.err, greeting, socksExchange{tt.request, tt.reply})
+	}
+}
+
+func TestSOCKS5ConnectWithoutAcceptableAuthentication(t *testing.T) {
+	assertSOCKSConnect(
+		t,
+		"SOCKS5",
+		pac.ProxyTypeSOCKS5,
+		"192.0.2.1:443",
+		"socks5: no acceptable authentication methods",
+		socksExchange{[]byte{0x05, 0x01, 0x00}, []byte{0x05, 0xff}},
+	)
+}
+
+func TestSOCKSConnectTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, server)
+	err := socksConnect(client, pac.ProxyTypeSOCKS5, "192.0.2.1:443", 50*time.Millisecond)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("expecting a timeout, got %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/williambailey/pacproxy/pac"
+)
+
+// writePEM writes blocks of type to a new file in dir
+func writePEM(t *testing.T, dir, name, typ string, blocks ...[]byte) string {
+	var data []byte
+	for _, b := range blocks {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b})...)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newClientCert creates a self signed client certificate and key
+func newClientCert(t *testing.T) (*x509.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "pacproxy test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, der, keyDER
+}
+
+// httpsProxy returns the "HTTPS" proxy that is listening at addr
+func httpsProxy(t *testing.T, addr string) pac.Proxy {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portStr)
+	return pac.Proxy{Type: pac.ProxyTypeHTTPS, Hostname: host, Port: port}
+}
+
+func TestUpstreamDialerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pacproxytls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clientCert, clientDER, clientKey := newClientCert(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	proxy := httpsProxy(t, srv.Listener.Addr().String())
+
+	ca := writePEM(t, dir, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+	cert := writePEM(t, dir, "client.pem", "CERTIFICATE", clientDER)
+	key := writePEM(t, dir, "client.key", "EC PRIVATE KEY", clientKey)
+
+	tests := []struct {
+		name       string
+		ca         string
+		cert       string
+		key        string
+		serverName string
+		ok         bool
+	}{
+		{"CAAndClientCert", ca, cert, key, "", true},
+		{"ServerName", ca, cert, key, "example.com", true},
+		{"WrongServerName", ca, cert, key, "other.example.net", false},
+		{"SystemCAs", "", cert, key, "", false},
+		{"NoClientCert", ca, "", "", "", false},
+	}
+	for _, tt := range tests {
+		cfg, err := newTLSConfig(tt.ca, tt.cert, tt.key, tt.serverName)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %q", tt.name, err)
+			continue
+		}
+		d := newUpstreamDialer(cfg)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := d.dial(ctx, proxy, "www.example.com:443")
+		cancel()
+		if err == nil {
+			// TLS 1.3 servers only check the client certificate after the
+			// handshake, so make sure that the connection is usable.
+			_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+			if err == nil {
+				_, err = conn.Read(make([]byte, 1))
+			}
+			conn.Close()
+		}
+		if tt.ok && err != nil {
+			t.Errorf("%s: unexpected error: %q", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: expecting an error", tt.name)
+		}
+	}
+}
+
+func TestNewTLSConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pacproxytls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	empty := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTLSConfig(empty, "", "", ""); err == nil {
+		t.Errorf("expecting an error for a CA file without certificates")
+	}
+	if _, err := newTLSConfig(filepath.Join(dir, "missing.pem"), "", "", ""); err == nil {
+		t.Errorf("expecting an error for a missing CA file")
+	}
+	if _, err := newTLSConfig("", empty, "", ""); err == nil || err.Error() != "both a client certificate and key are required" {
+		t.Errorf("expecting an error for a client certificate without a key, got %v", err)
+	}
+	if _, err := newTLSConfig("", empty, empty, ""); err == nil {
+		t.Errorf("expecting an error for an invalid client certificate")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/williambailey/pacproxy/pac"
+)
+
+// upstreamDialer makes connections to, or by way of, upstream proxies
+type upstreamDialer struct {
+	dialer    *net.Dialer
+	tlsConfig *tls.Config
+}
+
+// newUpstreamDialer using tlsConfig when talking to "HTTPS" upstream proxies
+func newUpstreamDialer(tlsConfig *tls.Config) *upstreamDialer {
+	return &upstreamDialer{
+		dialer: &net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 10 * time.Second,
+		},
+		tlsConfig: tlsConfig,
+	}
+}
+
+// dial connects to addr when proxy is DIRECT or a SOCKS proxy, otherwise it
+// connects to the proxy itself.
+func (d *upstreamDialer) dial(ctx context.Context, proxy pac.Proxy, addr string) (net.Conn, error) {
+	switch {
+	case proxy == pac.DirectProxy:
+		return d.dialer.DialContext(ctx, "tcp", addr)
+	case proxy.Type.IsSOCKS():
+		return d.dialSOCKS(ctx, proxy, addr)
+	}
+	return d.dialProxy(ctx, proxy)
+}
+
+// dialProxy connects to an upstream "PROXY" or "HTTPS" proxy, doing the TLS
+// handshake for the latter.
+func (d *upstreamDialer) dialProxy(ctx context.Context, proxy pac.Proxy) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, "tcp", proxy.Address())
+	if err != nil || proxy.Type != pac.ProxyTypeHTTPS {
+		return conn, err
+	}
+	cfg := d.tlsConfig.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = proxy.Hostname
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if d.dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.dialer.Timeout)
+		defer cancel()
+	}
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialSOCKS connects to addr by way of a SOCKS proxy
+func (d *upstreamDialer) dialSOCKS(ctx context.Context, proxy pac.Proxy, addr string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, "tcp", proxy.Address())
+	if err != nil {
+		return nil, err
+	}
+	if err := socksConnect(conn, proxy.Type, addr, d.dialer.Timeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// probe implements pac.ProbeFunc. Without a canary this is a plain connect
+// to the proxy, with one the proxy is also asked to connect to the canary.
+func (d *upstreamDialer) probe(ctx context.Context, proxy pac.Proxy, canary string) error {
+	var (
+		conn net.Conn
+		err  error
+	)
+	switch {
+	case proxy == pac.DirectProxy:
+		return nil
+	case proxy.Type.IsSOCKS() && canary == "":
+		conn, err = d.dialer.DialContext(ctx, "tcp", proxy.Address())
+	case proxy.Type.IsSOCKS():
+		conn, err = d.dialSOCKS(ctx, proxy, canary)
+	default:
+		conn, err = d.dialProxy(ctx, proxy)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if canary == "" || proxy.Type.IsSOCKS() {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: canary},
+		Host:   canary,
+		Header: make(http.Header),
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("CONNECT %s: %s", canary, resp.Status)
+	}
+	return nil
+}